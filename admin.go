@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	readerctx "github.com/bcurnow/magicband-reader/context"
+	"github.com/bcurnow/magicband-reader/event"
+	"github.com/bcurnow/magicband-reader/led"
+	"github.com/bcurnow/magicband-reader/reader"
+)
+
+const (
+	// The LED effects /led/effect supports
+	effectBlink = "blink"
+	effectChase = "chase"
+	effectFade  = "fade"
+	effectOn    = "on"
+	effectSpin  = "spin"
+
+	defaultEffectDuration = 3 * time.Second
+	// The hardware is unavailable to reads while an effect runs, so effects can't run forever
+	maxEffectDuration = 30 * time.Second
+	effectBlinkDelay  = 500 * time.Millisecond
+	effectChaseDelay  = 10 * time.Millisecond
+	effectChaseWidth  = 8
+	effectFadeDelay   = 10 * time.Millisecond
+
+	// The admin requests are small JSON objects
+	maxAdminRequestSize = 4 * 1024
+)
+
+type ledEffectRequest struct {
+	Effect string `json:"effect"`
+	// The color as hex RGB, e.g. "#00FF00" or "0x00FF00"
+	Color string `json:"color"`
+	// A Go duration, e.g. "5s"
+	Duration string `json:"duration"`
+	Reverse  bool   `json:"reverse"`
+}
+
+type audioPlayRequest struct {
+	// The name of a sound file in the cache
+	Sound string `json:"sound"`
+}
+
+type simulateReadRequest struct {
+	UID string `json:"uid"`
+	// Defaults to the first configured reader
+	ReaderID string `json:"reader_id"`
+}
+
+type adminResult struct {
+	Status string `json:"status"`
+}
+
+// validateAdminConfig makes sure the admin endpoints can't be enabled without authentication
+func validateAdminConfig(config RouterConfig) error {
+	if config.AdminAPI && config.APIKey == "" && config.TLSClientCAFile == "" {
+		return errors.New("invalid value for listen-admin-api: 'true', listen-api-key or listen-tls-client-ca must also be set")
+	}
+	return nil
+}
+
+// handleLEDEffectRequest runs an LED effect, it returns once the effect has finished
+func handleLEDEffectRequest(r *router, w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request ledEffectRequest
+	if err := decodeAdminRequest(w, req, &request); err != nil {
+		writeWebError(w, true, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	color, err := led.ParseColor(request.Color)
+	if err != nil {
+		writeWebError(w, true, http.StatusBadRequest, fmt.Sprintf("invalid value for color: '%v', must be a hex RGB color (e.g. #00FF00)", sanitizeForLog(request.Color)))
+		return
+	}
+	duration, err := parseEffectDuration(request.Duration)
+	if err != nil {
+		writeWebError(w, true, http.StatusBadRequest, err.Error())
+		return
+	}
+	effect, exists := ledEffects[request.Effect]
+	if !exists {
+		writeWebError(w, true, http.StatusBadRequest, fmt.Sprintf("invalid value for effect: '%v', must be one of: %v", sanitizeForLog(request.Effect), strings.Join(ledEffectNames(), ", ")))
+		return
+	}
+
+	// The handlers use the LED strip too, only one of them can drive it at a time
+	r.routeLock.Lock()
+	defer r.routeLock.Unlock()
+	log.Infof("Running LED effect '%v' (%#06x) for %v from %v", request.Effect, uint32(color), duration, req.RemoteAddr)
+	if err := effect(readerctx.LEDController, color, duration, request.Reverse); err != nil {
+		log.Errorf("handleLEDEffectRequest: effect '%v' failed: %v", request.Effect, err)
+		writeWebError(w, true, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, adminResult{Status: statusOK})
+}
+
+// handleAudioPlayRequest plays a sound from the cache, it returns once the sound has finished
+func handleAudioPlayRequest(r *router, w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request audioPlayRequest
+	if err := decodeAdminRequest(w, req, &request); err != nil {
+		writeWebError(w, true, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Only the files directly in the sound directory can be played
+	if request.Sound == "" || request.Sound != filepath.Base(request.Sound) || strings.HasPrefix(request.Sound, ".") {
+		writeWebError(w, true, http.StatusBadRequest, fmt.Sprintf("invalid value for sound: '%v', must be the name of a file in the sound cache", sanitizeForLog(request.Sound)))
+		return
+	}
+
+	buffer, err := readerctx.AudioController.LoadCached(request.Sound)
+	if err != nil {
+		log.Debugf("handleAudioPlayRequest: unable to load '%v': %v", sanitizeForLog(request.Sound), err)
+		writeWebError(w, true, http.StatusNotFound, fmt.Sprintf("unable to load sound '%v'", sanitizeForLog(request.Sound)))
+		return
+	}
+
+	r.routeLock.Lock()
+	defer r.routeLock.Unlock()
+	log.Infof("Playing '%v' from %v", request.Sound, req.RemoteAddr)
+	readerctx.AudioController.Play(buffer)
+	writeJSON(w, adminResult{Status: statusOK})
+}
+
+// handleSimulateReadRequest routes a UID as if it was read by a reader and returns the result
+func handleSimulateReadRequest(r *router, w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request simulateReadRequest
+	if err := decodeAdminRequest(w, req, &request); err != nil {
+		writeWebError(w, true, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Everything downstream (the logs, the handlers, the streams) expects a UID a reader could have produced
+	uid, err := reader.ParseUID(request.UID)
+	if err != nil {
+		writeWebError(w, true, http.StatusBadRequest, fmt.Sprintf("invalid value for uid: '%v', %v (e.g. 04A1B2C3D4E5F6)", sanitizeForLog(request.UID), err))
+		return
+	}
+	if request.ReaderID == "" && len(r.config.ReaderIDs) > 0 {
+		request.ReaderID = r.config.ReaderIDs[0]
+	}
+	if !slices.Contains(r.config.ReaderIDs, request.ReaderID) {
+		writeWebError(w, true, http.StatusBadRequest, fmt.Sprintf("invalid value for reader_id: '%v', must be one of: %v", sanitizeForLog(request.ReaderID), strings.Join(r.config.ReaderIDs, ", ")))
+		return
+	}
+
+	log.Infof("Simulating a read of '%v' on reader '%v' from %v", uid, request.ReaderID, req.RemoteAddr)
+	result, err := r.route(req.Context(), event.NewEvent(request.ReaderID, uid, event.UNKNOWN))
+	if err != nil {
+		writeWebError(w, true, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("X-Reader-ID", result.ReaderID)
+	writeJSON(w, result)
+}
+
+func decodeAdminRequest(w http.ResponseWriter, req *http.Request, request interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxAdminRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(request); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	return nil
+}
+
+func parseEffectDuration(duration string) (time.Duration, error) {
+	if duration == "" {
+		return defaultEffectDuration, nil
+	}
+	parsed, err := time.ParseDuration(duration)
+	if err != nil || parsed <= 0 || parsed > maxEffectDuration {
+		return 0, fmt.Errorf("invalid value for duration: '%v', must be a duration greater than 0 and at most %v", sanitizeForLog(duration), maxEffectDuration)
+	}
+	return parsed, nil
+}
+
+// ledEffect runs an effect for roughly duration and turns the LEDs off again
+type ledEffect func(controller led.Controller, color led.Color, duration time.Duration, reverse bool) error
+
+var ledEffects = map[string]ledEffect{
+	effectBlink: func(controller led.Controller, color led.Color, duration time.Duration, reverse bool) error {
+		return controller.Blink(color, max(1, int(duration/(2*effectBlinkDelay))), effectBlinkDelay)
+	},
+	effectChase: func(controller led.Controller, color led.Color, duration time.Duration, reverse bool) error {
+		for end := time.Now().Add(duration); time.Now().Before(end); {
+			if err := controller.ColorChase(color, effectChaseDelay, reverse, effectChaseWidth); err != nil {
+				return err
+			}
+		}
+		return controller.LightsOff()
+	},
+	effectFade: func(controller led.Controller, color led.Color, duration time.Duration, reverse bool) error {
+		if err := controller.FadeOn(color, effectFadeDelay); err != nil {
+			return err
+		}
+		time.Sleep(duration)
+		if err := controller.FadeOff(effectFadeDelay); err != nil {
+			return err
+		}
+		return controller.LightsOff()
+	},
+	effectOn: func(controller led.Controller, color led.Color, duration time.Duration, reverse bool) error {
+		if err := controller.LightsOn(color); err != nil {
+			return err
+		}
+		time.Sleep(duration)
+		return controller.LightsOff()
+	},
+	effectSpin: func(controller led.Controller, color led.Color, duration time.Duration, reverse bool) error {
+		stop := make(chan bool)
+		timer := time.AfterFunc(duration, func() { close(stop) })
+		defer timer.Stop()
+		if err := controller.Spin(color, reverse, effectChaseWidth, stop); err != nil {
+			return err
+		}
+		return controller.LightsOff()
+	},
+}
+
+func ledEffectNames() []string {
+	names := make([]string, 0, len(ledEffects))
+	for name := range ledEffects {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
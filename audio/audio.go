@@ -1,6 +1,7 @@
 package audio
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -12,6 +13,7 @@ import (
 	"github.com/gopxl/beep/v2/wav"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/bcurnow/magicband-reader/metrics"
 	"github.com/bcurnow/magicband-reader/rfidsecuritysvc"
 )
 
@@ -20,11 +22,17 @@ const (
 )
 
 type Controller interface {
-	Load(sound *rfidsecuritysvc.Sound) (*beep.Buffer, error)
+	// Load loads sound, downloading it if it isn't in the cache. Cancelling ctx aborts the download.
+	Load(ctx context.Context, sound *rfidsecuritysvc.Sound) (*beep.Buffer, error)
+	// LoadCached loads a sound which is already in the cache by name, it's not downloaded if it's missing
+	LoadCached(soundName string) (*beep.Buffer, error)
 	Play(buffer *beep.Buffer)
 	AuthorizedSound() *beep.Buffer
 	ReadSound() *beep.Buffer
 	UnauthorizedSound() *beep.Buffer
+	// FaultSound is played when a band couldn't be checked, it's the unauthorized sound unless a fault sound
+	// was configured
+	FaultSound() *beep.Buffer
 }
 
 type controller struct {
@@ -35,9 +43,10 @@ type controller struct {
 	authorizedSound   *beep.Buffer
 	readSound         *beep.Buffer
 	unauthorizedSound *beep.Buffer
+	faultSound        *beep.Buffer
 }
 
-func NewController(volume float64, base float64, cache Cache, authorizedSoundName string, readSoundName string, unauthorizedSoundName string) (Controller, error) {
+func NewController(volume float64, base float64, cache Cache, authorizedSoundName string, readSoundName string, unauthorizedSoundName string, faultSoundName string) (Controller, error) {
 	log.Trace("Creating new audio.Controller")
 
 	c := controller{
@@ -83,12 +92,26 @@ func NewController(volume float64, base float64, cache Cache, authorizedSoundNam
 	}
 	c.unauthorizedSound = buffer
 
+	c.faultSound = c.unauthorizedSound
+	if faultSoundName != "" {
+		f, err = cache.Get(faultSoundName)
+		if err != nil {
+			return nil, err
+		}
+		buffer, err = c.loadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		c.faultSound = buffer
+	}
+
 	return &c, nil
 }
 
-func (c *controller) Load(sound *rfidsecuritysvc.Sound) (*beep.Buffer, error) {
-	f, err := c.cache.Load(sound)
+func (c *controller) Load(ctx context.Context, sound *rfidsecuritysvc.Sound) (*beep.Buffer, error) {
+	f, err := c.cache.Load(ctx, sound)
 	if err != nil {
+		metrics.AudioErrors.Inc()
 		return nil, err
 	}
 	defer func() {
@@ -98,6 +121,20 @@ func (c *controller) Load(sound *rfidsecuritysvc.Sound) (*beep.Buffer, error) {
 	}()
 	soundBuffer, err := c.loadFile(f)
 	if err != nil {
+		metrics.AudioErrors.Inc()
+		return nil, err
+	}
+	return soundBuffer, nil
+}
+
+func (c *controller) LoadCached(soundName string) (*beep.Buffer, error) {
+	f, err := c.cache.Get(soundName)
+	if err != nil {
+		return nil, err
+	}
+	soundBuffer, err := c.loadFile(f)
+	if err != nil {
+		metrics.AudioErrors.Inc()
 		return nil, err
 	}
 	return soundBuffer, nil
@@ -132,6 +169,10 @@ func (c *controller) UnauthorizedSound() *beep.Buffer {
 	return c.unauthorizedSound
 }
 
+func (c *controller) FaultSound() *beep.Buffer {
+	return c.faultSound
+}
+
 func (c *controller) handleDefaults() {
 	if c.base == 0 {
 		c.base = defaultBase
@@ -1,10 +1,12 @@
 package audio
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"os"
 	"path"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 
@@ -14,13 +16,18 @@ import (
 type Cache interface {
 	CacheDir() string
 	Get(soundName string) (*os.File, error)
-	Load(sound *rfidsecuritysvc.Sound) (*os.File, error)
-	Sync() error
+	// Load returns the file for sound, downloading it if it isn't in the cache. Cancelling ctx aborts the download.
+	Load(ctx context.Context, sound *rfidsecuritysvc.Sound) (*os.File, error)
+	// Sync downloads any sounds which are missing or out of date. Cancelling ctx aborts the sync.
+	Sync(ctx context.Context) error
+	// Synced returns true once Sync has succeeded
+	Synced() bool
 }
 
 type cache struct {
 	rfidSecuritySvc rfidsecuritysvc.Service
 	soundDir        string
+	synced          atomic.Bool
 }
 
 func NewCache(svc rfidsecuritysvc.Service, soundDir string) (Cache, error) {
@@ -41,14 +48,14 @@ func (c *cache) Get(soundName string) (*os.File, error) {
 	return f, err
 }
 
-func (c *cache) Load(sound *rfidsecuritysvc.Sound) (*os.File, error) {
+func (c *cache) Load(ctx context.Context, sound *rfidsecuritysvc.Sound) (*os.File, error) {
 	f, err := c.Get(sound.Name)
 	if err == nil {
 		return f, nil
 	}
 
 	// File doesn't currently existing on the file system, download from the service
-	if err := c.writeSound(sound.ID); err != nil {
+	if err := c.writeSound(ctx, sound.ID); err != nil {
 		return nil, err
 	}
 
@@ -60,8 +67,8 @@ func (c *cache) Load(sound *rfidsecuritysvc.Sound) (*os.File, error) {
 	return f, nil
 }
 
-func (c *cache) Sync() error {
-	mappedSounds, err := c.mapSounds()
+func (c *cache) Sync(ctx context.Context) error {
+	mappedSounds, err := c.mapSounds(ctx)
 	if err != nil {
 		return err
 	}
@@ -81,22 +88,27 @@ func (c *cache) Sync() error {
 
 			if fsInfo.ModTime().Before(sound.LastUpdateTimestamp) {
 				log.Debugf("%v found but out of date, updating", dirInfo.Name())
-				if err := c.writeSound(sound.ID); err != nil {
+				if err := c.writeSound(ctx, sound.ID); err != nil {
 					return err
 				}
 			}
 		} else {
 			log.Debugf("%v not found, downloading to %v", sound.Name, c.soundDir)
-			if err := c.writeSound(sound.ID); err != nil {
+			if err := c.writeSound(ctx, sound.ID); err != nil {
 				return err
 			}
 		}
 	}
+	c.synced.Store(true)
 	return nil
 }
 
-func (c *cache) writeSound(id int) error {
-	sound, err := c.rfidSecuritySvc.Sounds().Get(id)
+func (c *cache) Synced() bool {
+	return c.synced.Load()
+}
+
+func (c *cache) writeSound(ctx context.Context, id int) error {
+	sound, err := c.rfidSecuritySvc.Sounds().GetContext(ctx, id)
 	if err != nil {
 		return err
 	}
@@ -112,8 +124,8 @@ func (c *cache) writeSound(id int) error {
 	return nil
 }
 
-func (c *cache) mapSounds() (map[string]rfidsecuritysvc.Sound, error) {
-	sounds, err := c.rfidSecuritySvc.Sounds().List()
+func (c *cache) mapSounds(ctx context.Context) (map[string]rfidsecuritysvc.Sound, error) {
+	sounds, err := c.rfidSecuritySvc.Sounds().ListContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,285 @@
+/*
+ * The audit package reports the outcome of every read to rfid-security-svc. An event which can't be delivered
+ * is written to an outbox directory and retried until it is, so the audit trail survives the service being
+ * down and the reader restarting.
+ */
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bcurnow/magicband-reader/event"
+	"github.com/bcurnow/magicband-reader/metrics"
+	"github.com/bcurnow/magicband-reader/rfidsecuritysvc"
+)
+
+const (
+	outboxExtension = ".json"
+)
+
+// ErrOutboxFull is returned when an event can't be delivered and the outbox already holds max-events
+var ErrOutboxFull = errors.New("audit outbox is full")
+
+type Outbox interface {
+	// Send queues auditEvent in the outbox, events are delivered in the order they were sent. An error means
+	// the event was lost.
+	Send(auditEvent rfidsecuritysvc.AuditEvent) error
+	// Pending returns the number of events waiting in the outbox
+	Pending() int
+	Close()
+}
+
+type outbox struct {
+	rfidSecuritySvc rfidsecuritysvc.Service
+	dir             string
+	retryInterval   time.Duration
+	// 0 means no limit
+	maxEvents int
+	// Events are queued one at a time so the outbox can't grow past maxEvents, only retry removes them
+	lock   sync.Mutex
+	cancel context.CancelFunc
+	done   chan bool
+	// Wakes retry as soon as an event is queued rather than at the next retry interval
+	wake chan struct{}
+	// Only used by retry, so the first failed delivery is a warning rather than every one
+	failing bool
+}
+
+// NewOutbox creates the outbox and starts retrying any events left in dir. The directory is only created
+// once an event needs to be queued.
+func NewOutbox(svc rfidsecuritysvc.Service, dir string, retryInterval time.Duration, maxEvents int) (Outbox, error) {
+	log.Trace("Creating new audit.Outbox")
+	if dir == "" {
+		return nil, fmt.Errorf("invalid value for audit-outbox-dir: '', must be set")
+	}
+	if retryInterval <= 0 {
+		return nil, fmt.Errorf("invalid value for audit-retry-interval: '%v', must be greater than 0", retryInterval)
+	}
+	if maxEvents < 0 {
+		return nil, fmt.Errorf("invalid value for audit-outbox-max-events: '%v', must not be negative", maxEvents)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &outbox{
+		rfidSecuritySvc: svc,
+		dir:             dir,
+		retryInterval:   retryInterval,
+		maxEvents:       maxEvents,
+		cancel:          cancel,
+		done:            make(chan bool),
+		wake:            make(chan struct{}, 1),
+	}
+	metrics.AuditOutboxSize.Set(float64(o.Pending()))
+	go o.retry(ctx)
+	return o, nil
+}
+
+// NewEvent creates the audit event for e, permission is what e was checked against
+func NewEvent(e event.Event, permission string) (rfidsecuritysvc.AuditEvent, error) {
+	id, err := newID()
+	if err != nil {
+		return rfidsecuritysvc.AuditEvent{}, fmt.Errorf("unable to create an ID for the audit event for '%v': %w", e.UID(), err)
+	}
+	auditEvent := rfidsecuritysvc.AuditEvent{
+		ID:         id,
+		UID:        e.UID(),
+		Permission: permission,
+		Outcome:    e.Type().String(),
+		ReaderID:   e.ReaderID(),
+		Timestamp:  e.Timestamp(),
+	}
+	if e.Reason() != event.NO_REASON {
+		auditEvent.Reason = e.Reason().String()
+	}
+	return auditEvent, nil
+}
+
+// Send never calls the service itself, delivering from the pipeline would hold up the read and could
+// overtake the events which are already queued
+func (o *outbox) Send(auditEvent rfidsecuritysvc.AuditEvent) error {
+	if err := o.enqueue(auditEvent); err != nil {
+		metrics.AuditEvents.WithLabelValues("dropped").Inc()
+		return fmt.Errorf("unable to queue the audit event for '%v': %w", auditEvent.UID, err)
+	}
+	metrics.AuditEvents.WithLabelValues("queued").Inc()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+		// retry is already due to run
+	}
+	return nil
+}
+
+func (o *outbox) Pending() int {
+	return len(o.files())
+}
+
+// Close stops retrying, anything still in the outbox is retried the next time we start
+func (o *outbox) Close() {
+	log.Trace("Closing audit.Outbox")
+	o.cancel()
+	<-o.done
+}
+
+// enqueue writes auditEvent to the outbox, the file is written under a temporary name and renamed so a
+// partially written event is never delivered
+func (o *outbox) enqueue(auditEvent rfidsecuritysvc.AuditEvent) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.maxEvents > 0 && o.Pending() >= o.maxEvents {
+		return ErrOutboxFull
+	}
+
+	data, err := json.Marshal(auditEvent)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(o.dir, 0750); err != nil {
+		return err
+	}
+	// Named so the files sort in the order the reads happened
+	name := fmt.Sprintf("%020d-%v", auditEvent.Timestamp.UnixNano(), auditEvent.ID)
+	tmpFile := path.Join(o.dir, name+".tmp")
+	if err := os.WriteFile(tmpFile, data, 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, path.Join(o.dir, name+outboxExtension)); err != nil {
+		if removeErr := os.Remove(tmpFile); removeErr != nil {
+			log.Errorf("Unable to remove %v from the audit outbox: %v", tmpFile, removeErr)
+		}
+		return err
+	}
+	metrics.AuditOutboxSize.Set(float64(o.Pending()))
+	return nil
+}
+
+// retry delivers the events in the outbox as they're queued, and every retry interval, until ctx is cancelled
+func (o *outbox) retry(ctx context.Context) {
+	defer close(o.done)
+	ticker := time.NewTicker(o.retryInterval)
+	defer ticker.Stop()
+	for {
+		o.deliver(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// deliver sends the events in the outbox oldest first, it stops at the first one which can't be delivered
+// as the rest are going to fail the same way
+func (o *outbox) deliver(ctx context.Context) {
+	defer func() {
+		metrics.AuditOutboxSize.Set(float64(o.Pending()))
+	}()
+
+	files := o.files()
+	if len(files) > 0 {
+		log.Debugf("Delivering %v audit events from %v", len(files), o.dir)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Errorf("Unable to read audit event %v, will retry in %v: %v", file, o.retryInterval, err)
+			return
+		}
+		var auditEvent rfidsecuritysvc.AuditEvent
+		if err := json.Unmarshal(data, &auditEvent); err != nil {
+			// It's never going to be deliverable, don't let it block the rest
+			log.Errorf("Dropping corrupt audit event %v: %v", file, err)
+			metrics.AuditEvents.WithLabelValues("dropped").Inc()
+			o.remove(file)
+			continue
+		}
+
+		err = o.rfidSecuritySvc.Audit(ctx, auditEvent)
+		switch {
+		case err == nil:
+			log.Debugf("Delivered the audit event for '%v' from %v", auditEvent.UID, file)
+			metrics.AuditEvents.WithLabelValues("delivered").Inc()
+		case rejected(err):
+			log.Errorf("Dropping the audit event for '%v' from %v, it was rejected: %v", auditEvent.UID, file, err)
+			metrics.AuditEvents.WithLabelValues("rejected").Inc()
+		default:
+			// Includes ctx being cancelled, e.g. we're shutting down, the event is delivered once we're back up
+			switch {
+			case ctx.Err() != nil:
+			case !o.failing:
+				log.Warnf("Unable to deliver the audit events in %v, will retry every %v: %v", o.dir, o.retryInterval, err)
+			default:
+				log.Debugf("Unable to deliver the audit events in %v, will retry in %v: %v", o.dir, o.retryInterval, err)
+			}
+			o.failing = true
+			return
+		}
+		o.failing = false
+		o.remove(file)
+	}
+}
+
+// files returns the events in the outbox, oldest first
+func (o *outbox) files() []string {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Unable to read the audit outbox %v: %v", o.dir, err)
+		}
+		return nil
+	}
+
+	// ReadDir sorts by name
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), outboxExtension) {
+			files = append(files, path.Join(o.dir, entry.Name()))
+		}
+	}
+	return files
+}
+
+func (o *outbox) remove(file string) {
+	if err := os.Remove(file); err != nil {
+		log.Errorf("Unable to remove %v from the audit outbox: %v", file, err)
+	}
+}
+
+// rejected returns true if the service refused the event itself, retrying it won't change the answer. The
+// status codes which can be fixed without changing the event (e.g. a bad API key, or a service which
+// doesn't support auditing yet) are retried.
+func rejected(err error) bool {
+	var statusErr *rfidsecuritysvc.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode < 400 || statusErr.StatusCode >= 500 {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return true
+}
+
+// newID returns a random ID, the service relies on it being unique to ignore an event it's already received
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
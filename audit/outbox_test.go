@@ -0,0 +1,143 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bcurnow/magicband-reader/rfidsecuritysvc"
+)
+
+// fakeService records the events it's sent, Audit fails while down is set and blocks while blocked is
+// open
+type fakeService struct {
+	rfidsecuritysvc.Service
+	lock      sync.Mutex
+	down      bool
+	blocked   chan struct{}
+	delivered []string
+}
+
+func (s *fakeService) Audit(ctx context.Context, auditEvent rfidsecuritysvc.AuditEvent) error {
+	s.lock.Lock()
+	blocked := s.blocked
+	s.lock.Unlock()
+	if blocked != nil {
+		select {
+		case <-blocked:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.down {
+		return errors.New("connection refused")
+	}
+	s.delivered = append(s.delivered, auditEvent.UID)
+	return nil
+}
+
+func (s *fakeService) setDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.down = down
+}
+
+func (s *fakeService) deliveredUIDs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.delivered...)
+}
+
+func newTestEvent(t *testing.T, uid string) rfidsecuritysvc.AuditEvent {
+	t.Helper()
+	id, err := newID()
+	if err != nil {
+		t.Fatalf("newID: %v", err)
+	}
+	return rfidsecuritysvc.AuditEvent{ID: id, UID: uid, Timestamp: time.Now()}
+}
+
+// waitFor fails the test if the service hasn't received want, in order, within a second
+func waitFor(t *testing.T, svc *fakeService, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if fmt.Sprint(svc.deliveredUIDs()) == fmt.Sprint(want) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("delivered %v, want %v", svc.deliveredUIDs(), want)
+}
+
+func TestOutboxDeliversInOrder(t *testing.T) {
+	svc := &fakeService{down: true}
+	o, err := NewOutbox(svc, t.TempDir(), 20*time.Millisecond, 0)
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	defer o.Close()
+
+	for _, uid := range []string{"00000001", "00000002"} {
+		if err := o.Send(newTestEvent(t, uid)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	// The service is back before the next read, it mustn't overtake the events which are queued
+	svc.setDown(false)
+	if err := o.Send(newTestEvent(t, "00000003")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	waitFor(t, svc, []string{"00000001", "00000002", "00000003"})
+	if pending := o.Pending(); pending != 0 {
+		t.Errorf("got %v pending events, want 0", pending)
+	}
+}
+
+func TestOutboxSendDoesNotWaitForTheService(t *testing.T) {
+	svc := &fakeService{blocked: make(chan struct{})}
+	o, err := NewOutbox(svc, t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	defer o.Close()
+
+	sent := make(chan error)
+	go func() {
+		sent <- o.Send(newTestEvent(t, "00000001"))
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send waited for the service")
+	}
+
+	close(svc.blocked)
+	waitFor(t, svc, []string{"00000001"})
+}
+
+func TestOutboxFull(t *testing.T) {
+	svc := &fakeService{down: true}
+	o, err := NewOutbox(svc, t.TempDir(), time.Hour, 1)
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	defer o.Close()
+
+	if err := o.Send(newTestEvent(t, "00000001")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := o.Send(newTestEvent(t, "00000002")); !errors.Is(err, ErrOutboxFull) {
+		t.Errorf("Send to a full outbox: got %v, want %v", err, ErrOutboxFull)
+	}
+}
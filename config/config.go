@@ -4,77 +4,245 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/peterbourgon/ff/v3"
-	"github.com/peterbourgon/ff/v3/ffyaml"
 )
 
 var (
-	ApiKey            string
-	ApiSSLVerify      string
-	ApiUrl            string
-	AuthorizedSound   string
-	Brightness        int
-	ConfigFile        string
-	InnerRingSize     int
-	ListenAddress     string
-	ListenPort        int
-	OuterRingSize     int
-	Permission        string
-	ReadSound         string
-	SoundDir          string
-	UnauthorizedSound string
-	VolumeLevel       float64
+	ApiBreakerCooldown         time.Duration
+	ApiBreakerThreshold        int
+	ApiKey                     string
+	ApiRetries                 int
+	ApiRetryBackoff            time.Duration
+	ApiSendTagData             bool
+	ApiSSLVerify               string
+	ApiSyncTimeout             time.Duration
+	ApiTimeout                 time.Duration
+	ApiTLSClientCert           string
+	ApiTLSClientKey            string
+	ApiTLSServerName           string
+	ApiUrl                     string
+	AuditOutboxDir             string
+	AuditOutboxMaxEvents       int
+	AuditRetryInterval         time.Duration
+	AuthorizedSound            string
+	Brightness                 int
+	ConfigFile                 string
+	FaultSound                 string
+	HandlerTimeout             time.Duration
+	InnerRingSize              int
+	ListenAPIKey               string
+	ListenAddress              string
+	ListenAdminAPI             bool
+	ListenPort                 int
+	ListenTLSCert              string
+	ListenTLSClientCA          string
+	ListenTLSKey               string
+	OuterRingSize              int
+	Permission                 string
+	Pipeline                   []Step
+	ReadSound                  string
+	ReaderAntennaGain          int
+	ReaderEvdevDevice          string
+	ReaderEvdevGrab            bool
+	ReaderEvdevUIDFormat       string
+	ReaderI2CAddress           int
+	ReaderI2CBus               string
+	ReaderIRQPin               string
+	ReaderPN532Interface       string
+	ReaderPollTimeout          time.Duration
+	ReaderReadTagData          bool
+	ReaderRemovalPolls         int
+	ReaderResetPin             string
+	ReaderSimulatedSource      string
+	ReaderSPIBus               int
+	ReaderSPIDevice            int
+	ReaderSPISpeed             string
+	ReaderType                 string
+	ReaderUARTBaud             int
+	ReaderUARTPort             string
+	ReaderWatchdogInterval     time.Duration
+	ReaderWatchdogMaxErrors    int
+	ReaderWatchdogMaxIdle      time.Duration
+	Readers                    []Reader
+	SoundDir                   string
+	UnauthorizedSound          string
+	VolumeLevel                float64
+	WebWaitersSuppressHandlers bool
 )
 
 func init() {
+	// Test binaries have flags of their own, the tests set up the config they need themselves
+	if testing.Testing() {
+		return
+	}
+
 	fs := flag.NewFlagSet("magicband-reader", flag.ExitOnError)
 	var (
-		apiKey            = fs.String("api-key", "", "The API key to authenticate to rfid-security-svc")
-		apiSSLVerify      = fs.String("api-ssl-verify", "ca.pem", "If 'True' or a valid file reference, performs SSL validation, if false, skips validation (this is insecure!).")
-		apiUrl            = fs.String("api-url", "https://localhost:5000/api/v1.0", "The rfid-security-svc base URL.")
-		authorizedSound   = fs.String("authorized-sound", "authorized.wav", "The name of the sound file played when a band is authorized (relative to sound-dir).")
-		brightness        = fs.Int("brightness", 100, "The brightness level of the LEDs. Range of 0 to 255 inclusive")
-		configFile        = fs.String("config-file", "/etc/magicband-reader/magicband-reader.yml", "The YAML configuration file to load.")
-		innerRingSize     = fs.Int("inner-ring-size", 20, "The number of LEDs that make up the inner ring.")
-		listenAddress     = fs.String("listen-address", "localhost", "The address to listen on, since the listener has no security, it's not recommended to change this value.")
-		listenPort        = fs.Int("listen-port", 8080, "The port number to listen for requests for UID (e.g. from rfid-security-svc)")
-		logLevel          = fs.String("log-level", "info", "One of: debug, info, warning, error fatal.")
-		logReportCaller   = fs.Bool("log-report-caller", false, "Includes the calling function, file, and line number (caller) in log lines. Only works when log-level = trace")
-		outerRingSize     = fs.Int("outer-ring-size", 40, "The number of LEDs that make up the outer ring.")
-		permission        = fs.String("permission", "MagicBand Reader", "The name of the permission to validate before authorizing.")
-		readSound         = fs.String("read-sound", "read.wav", "The name of the sound file played when a band is read (relative to sound-dir).")
-		soundDir          = fs.String("sound-dir", "/sounds", "The directory containing the sound files.")
-		unauthorizedSound = fs.String("unauthorized-sound", "unauthorized.wav", "The name of the sound file played when a band is unauthorized (relative to sound-dir).")
-		volumeLevel       = fs.Float64("volume-level", 0, "Positive or negative value which is applied to the volume base to adjust the sound.")
+		apiBreakerCooldown         = fs.Duration("api-breaker-cooldown", 30*time.Second, "How long rfid-security-svc isn't called for once the circuit breaker opens.")
+		apiBreakerThreshold        = fs.Int("api-breaker-threshold", 5, "The number of failed rfid-security-svc calls in a row which open the circuit breaker, 0 disables the circuit breaker.")
+		apiKey                     = fs.String("api-key", "", "The API key to authenticate to rfid-security-svc")
+		apiRetries                 = fs.Int("api-retries", 2, "How many times a rfid-security-svc request which failed because of a fault (no response, a 429 or a 5xx) is retried.")
+		apiRetryBackoff            = fs.Duration("api-retry-backoff", 200*time.Millisecond, "The delay before the first retry, it doubles for each retry after that (with jitter).")
+		apiSendTagData             = fs.Bool("api-send-tag-data", false, "If true, the tag type and NDEF records read with reader-read-tag-data are sent with the authorization request. Only enable it if rfid-security-svc supports the tag_type and ndef query parameters.")
+		apiSSLVerify               = fs.String("api-ssl-verify", "ca.pem", "If 'True' or a valid file reference, performs SSL validation, if false, skips validation (this is insecure!).")
+		apiSyncTimeout             = fs.Duration("api-sync-timeout", 60*time.Second, "How long a single rfid-security-svc request while syncing the sounds can take.")
+		apiTimeout                 = fs.Duration("api-timeout", 5*time.Second, "How long a single rfid-security-svc authorization request can take.")
+		apiTLSClientCert           = fs.String("api-tls-client-cert", "", "A client certificate file to authenticate to rfid-security-svc with (mTLS), it's reloaded when the file changes.")
+		apiTLSClientKey            = fs.String("api-tls-client-key", "", "The private key file for api-tls-client-cert, it's reloaded when the file changes.")
+		apiTLSServerName           = fs.String("api-tls-server-name", "", "The name to validate the rfid-security-svc certificate against (and send as SNI) instead of the host in api-url.")
+		apiUrl                     = fs.String("api-url", "https://localhost:5000/api/v1.0", "The rfid-security-svc base URL.")
+		auditOutboxDir             = fs.String("audit-outbox-dir", "/audit-outbox", "The directory audit events which couldn't be delivered to rfid-security-svc are kept in until they are.")
+		auditOutboxMaxEvents       = fs.Int("audit-outbox-max-events", 10000, "The most audit events the outbox holds, events which can't be delivered once it's full are lost, 0 means no limit.")
+		auditRetryInterval         = fs.Duration("audit-retry-interval", 30*time.Second, "How often delivering the audit events in the outbox is retried.")
+		authorizedSound            = fs.String("authorized-sound", "authorized.wav", "The name of the sound file played when a band is authorized (relative to sound-dir).")
+		brightness                 = fs.Int("brightness", 100, "The brightness level of the LEDs. Range of 0 to 255 inclusive")
+		configFile                 = fs.String("config-file", "/etc/magicband-reader/magicband-reader.yml", "The YAML configuration file to load.")
+		faultSound                 = fs.String("fault-sound", "", "The name of the sound file played when a band couldn't be checked because rfid-security-svc failed or is unreachable (relative to sound-dir), defaults to unauthorized-sound.")
+		handlerTimeout             = fs.Duration("handler-timeout", 30*time.Second, "How long a handler in the pipeline can run before it's considered failed, 0 disables the timeout. Can be set for each step in the pipeline.")
+		innerRingSize              = fs.Int("inner-ring-size", 20, "The number of LEDs that make up the inner ring.")
+		listenAPIKey               = fs.String("listen-api-key", "", "If set, requests to the listener (other than /healthz and /readyz) must include this API key in the X-MAGICBAND-READER-API-KEY header.")
+		listenAddress              = fs.String("listen-address", "localhost", "The address to listen on. Before listening on anything other than localhost, secure the listener with listen-api-key and/or TLS.")
+		listenAdminAPI             = fs.Bool("listen-admin-api", false, "Enables the admin endpoints (/led/effect, /audio/play and /simulate/read). Requires listen-api-key or listen-tls-client-ca.")
+		listenPort                 = fs.Int("listen-port", 8080, "The port number to listen for requests for UID (e.g. from rfid-security-svc)")
+		listenTLSCert              = fs.String("listen-tls-cert", "", "The certificate file (PEM) to serve TLS with, TLS is enabled when this and listen-tls-key are set.")
+		listenTLSClientCA          = fs.String("listen-tls-client-ca", "", "If set, clients must present a certificate signed by a CA in this file (PEM). Requires TLS.")
+		listenTLSKey               = fs.String("listen-tls-key", "", "The private key file (PEM) for listen-tls-cert.")
+		logLevel                   = fs.String("log-level", "info", "One of: debug, info, warning, error fatal.")
+		logReportCaller            = fs.Bool("log-report-caller", false, "Includes the calling function, file, and line number (caller) in log lines. Only works when log-level = trace")
+		outerRingSize              = fs.Int("outer-ring-size", 40, "The number of LEDs that make up the outer ring.")
+		permission                 = fs.String("permission", "MagicBand Reader", "The name of the permission to validate before authorizing.")
+		readSound                  = fs.String("read-sound", "read.wav", "The name of the sound file played when a band is read (relative to sound-dir).")
+		readerAntennaGain          = fs.Int("reader-antenna-gain", 5, "The MFRC522 antenna gain. Range of 0 to 7 inclusive")
+		readerEvdevDevice          = fs.String("reader-evdev-device", "/dev/input/event0", "The input device of a USB keyboard wedge reader. Only used when reader-type = evdev")
+		readerEvdevGrab            = fs.Bool("reader-evdev-grab", true, "Grab the input device exclusively so the UIDs aren't also typed into the console. Only used when reader-type = evdev")
+		readerEvdevUIDFormat       = fs.String("reader-evdev-uid-format", "decimal", "How the keyboard wedge reader types the UID, one of: decimal, decimal-reversed (least significant byte first), hex. Only used when reader-type = evdev")
+		readerI2CAddress           = fs.Int("reader-i2c-address", 0x24, "The I2C address of the PN532. Only used when reader-pn532-interface = i2c")
+		readerI2CBus               = fs.String("reader-i2c-bus", "", "The periph name of the I2C bus the PN532 is connected to, defaults to the first bus. Only used when reader-pn532-interface = i2c")
+		readerIRQPin               = fs.String("reader-irq-pin", "GPIO24", "The periph name of the GPIO pin connected to the MFRC522 IRQ line (default is physical pin 18).")
+		readerPN532Interface       = fs.String("reader-pn532-interface", "i2c", "How the PN532 is connected, one of: i2c, spi, uart. Only used when reader-type = pn532")
+		readerPollTimeout          = fs.Duration("reader-poll-timeout", 500*time.Millisecond, "How long a single poll waits for a band before it counts as a miss.")
+		readerRemovalPolls         = fs.Int("reader-removal-polls", 4, "The number of consecutive missed polls before a band is considered removed, a band read again before then isn't reported again.")
+		readerReadTagData          = fs.Bool("reader-read-tag-data", false, "Read the tag type (ATQA/SAK) and the user memory and NDEF records of NTAG/MIFARE Ultralight bands along with the UID. Only used when reader-type = mfrc522 or pn532")
+		readerResetPin             = fs.String("reader-reset-pin", "GPIO25", "The periph name of the GPIO pin connected to the MFRC522 reset line (default is physical pin 22).")
+		readerSimulatedSource      = fs.String("reader-simulated-source", "-", "Where the simulated reader reads UIDs from: '-' for stdin, the path to a FIFO, or the path to a timeline file. Only used when reader-type = simulated")
+		readerSPIBus               = fs.Int("reader-spi-bus", 0, "The SPI bus the MFRC522 is connected to.")
+		readerSPIDevice            = fs.Int("reader-spi-device", 0, "The SPI device (chip select) the MFRC522 is connected to.")
+		readerSPISpeed             = fs.String("reader-spi-speed", "10MHz", "The maximum SPI clock speed used to talk to the MFRC522 (e.g. 1MHz).")
+		readerType                 = fs.String("reader-type", "mfrc522", "The reader backend to use, one of: evdev, mfrc522, pn532, simulated.")
+		readerUARTBaud             = fs.Int("reader-uart-baud", 115200, "The baud rate of the PN532 serial port. Only used when reader-pn532-interface = uart")
+		readerUARTPort             = fs.String("reader-uart-port", "/dev/serial0", "The serial device the PN532 is connected to. Only used when reader-pn532-interface = uart")
+		readerWatchdogInterval     = fs.Duration("reader-watchdog-interval", 30*time.Second, "How often the reader hardware is checked and recovered if needed, 0 disables the watchdog. Only used when reader-type = mfrc522 or pn532")
+		readerWatchdogMaxErrors    = fs.Int("reader-watchdog-max-errors", 10, "The number of read errors (IRQ errors and retries) between two watchdog checks which cause the reader to be recovered.")
+		readerWatchdogMaxIdle      = fs.Duration("reader-watchdog-max-idle", 6*time.Hour, "Recover the reader if nothing has been read for this long and it's reported errors since the last read, 0 disables this check.")
+		soundDir                   = fs.String("sound-dir", "/sounds", "The directory containing the sound files.")
+		unauthorizedSound          = fs.String("unauthorized-sound", "unauthorized.wav", "The name of the sound file played when a band is unauthorized (relative to sound-dir).")
+		volumeLevel                = fs.Float64("volume-level", 0, "Positive or negative value which is applied to the volume base to adjust the sound.")
+		webWaitersSuppressHandlers = fs.Bool("web-waiters-suppress-handlers", true, "If true, a read while /get_uid requests are waiting is only returned to them, otherwise it's also sent through the handlers (and returned once it's been handled).")
 	)
 
 	if err := ff.Parse(fs, os.Args[1:],
 		ff.WithEnvVarPrefix("MR"),
 		ff.WithConfigFileFlag("config-file"),
-		ff.WithConfigFileParser(ffyaml.Parser),
+		ff.WithConfigFileParser(yamlParser),
 		ff.WithAllowMissingConfigFile(true),
 	); err != nil {
 		panic(err)
 	}
 
+	ApiBreakerCooldown = *apiBreakerCooldown
+	ApiBreakerThreshold = *apiBreakerThreshold
 	ApiKey = *apiKey
+	ApiRetries = *apiRetries
+	ApiRetryBackoff = *apiRetryBackoff
+	ApiSendTagData = *apiSendTagData
 	ApiSSLVerify = *apiSSLVerify
+	ApiSyncTimeout = *apiSyncTimeout
+	ApiTimeout = *apiTimeout
+	ApiTLSClientCert = *apiTLSClientCert
+	ApiTLSClientKey = *apiTLSClientKey
+	ApiTLSServerName = *apiTLSServerName
 	ApiUrl = *apiUrl
+	AuditOutboxDir = *auditOutboxDir
+	AuditOutboxMaxEvents = *auditOutboxMaxEvents
+	AuditRetryInterval = *auditRetryInterval
 	AuthorizedSound = *authorizedSound
 	Brightness = *brightness
 	ConfigFile = *configFile
+	FaultSound = *faultSound
+	HandlerTimeout = *handlerTimeout
 	InnerRingSize = *innerRingSize
+	ListenAPIKey = *listenAPIKey
 	ListenAddress = *listenAddress
+	ListenAdminAPI = *listenAdminAPI
 	ListenPort = *listenPort
+	ListenTLSCert = *listenTLSCert
+	ListenTLSClientCA = *listenTLSClientCA
+	ListenTLSKey = *listenTLSKey
 	OuterRingSize = *outerRingSize
 	Permission = *permission
 	ReadSound = *readSound
+	ReaderAntennaGain = *readerAntennaGain
+	ReaderEvdevDevice = *readerEvdevDevice
+	ReaderEvdevGrab = *readerEvdevGrab
+	ReaderEvdevUIDFormat = *readerEvdevUIDFormat
+	ReaderI2CAddress = *readerI2CAddress
+	ReaderI2CBus = *readerI2CBus
+	ReaderIRQPin = *readerIRQPin
+	ReaderPN532Interface = *readerPN532Interface
+	ReaderPollTimeout = *readerPollTimeout
+	ReaderReadTagData = *readerReadTagData
+	ReaderRemovalPolls = *readerRemovalPolls
+	ReaderResetPin = *readerResetPin
+	ReaderSimulatedSource = *readerSimulatedSource
+	ReaderSPIBus = *readerSPIBus
+	ReaderSPIDevice = *readerSPIDevice
+	ReaderSPISpeed = *readerSPISpeed
+	ReaderType = *readerType
+	ReaderUARTBaud = *readerUARTBaud
+	ReaderUARTPort = *readerUARTPort
+	ReaderWatchdogInterval = *readerWatchdogInterval
+	ReaderWatchdogMaxErrors = *readerWatchdogMaxErrors
+	ReaderWatchdogMaxIdle = *readerWatchdogMaxIdle
 	SoundDir = *soundDir
 	UnauthorizedSound = *unauthorizedSound
 	VolumeLevel = *volumeLevel
+	WebWaitersSuppressHandlers = *webWaitersSuppressHandlers
+
+	readers, err := loadReaders(ConfigFile, Reader{
+		Type:            ReaderType,
+		Permission:      Permission,
+		SimulatedSource: ReaderSimulatedSource,
+		SPIBus:          ReaderSPIBus,
+		SPIDevice:       ReaderSPIDevice,
+		SPISpeed:        ReaderSPISpeed,
+		ResetPin:        ReaderResetPin,
+		IRQPin:          ReaderIRQPin,
+		AntennaGain:     ReaderAntennaGain,
+		ReadTagData:     ReaderReadTagData,
+		PN532Interface:  ReaderPN532Interface,
+		I2CBus:          ReaderI2CBus,
+		I2CAddress:      ReaderI2CAddress,
+		UARTPort:        ReaderUARTPort,
+		UARTBaud:        ReaderUARTBaud,
+		EvdevDevice:     ReaderEvdevDevice,
+		EvdevGrab:       ReaderEvdevGrab,
+		EvdevUIDFormat:  ReaderEvdevUIDFormat,
+	})
+	if err != nil {
+		panic(err)
+	}
+	Readers = readers
+
+	pipeline, err := loadPipeline(ConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	Pipeline = pipeline
 
 	level, err := validateLogLevel(*logLevel, "log-level")
 	if err != nil {
@@ -86,23 +254,72 @@ func init() {
 }
 
 func logConfig(configFile string, level log.Level, logReportCaller bool) {
+	log.Debugf("api-breaker-cooldown: %v", ApiBreakerCooldown)
+	log.Debugf("api-breaker-threshold: %v", ApiBreakerThreshold)
 	log.Debug("api-key: <redacted>")
+	log.Debugf("api-retries: %v", ApiRetries)
+	log.Debugf("api-retry-backoff: %v", ApiRetryBackoff)
+	log.Debugf("api-send-tag-data: %v", ApiSendTagData)
 	log.Debugf("api-ssl-verify: %v", ApiSSLVerify)
+	log.Debugf("api-sync-timeout: %v", ApiSyncTimeout)
+	log.Debugf("api-timeout: %v", ApiTimeout)
+	log.Debugf("api-tls-client-cert: %v", ApiTLSClientCert)
+	log.Debugf("api-tls-client-key: %v", ApiTLSClientKey)
+	log.Debugf("api-tls-server-name: %v", ApiTLSServerName)
 	log.Debugf("api-url: %v", ApiUrl)
+	log.Debugf("audit-outbox-dir: %v", AuditOutboxDir)
+	log.Debugf("audit-outbox-max-events: %v", AuditOutboxMaxEvents)
+	log.Debugf("audit-retry-interval: %v", AuditRetryInterval)
 	log.Debugf("authorized-sound: %v", AuthorizedSound)
 	log.Debugf("brightness: %v", Brightness)
 	log.Debugf("config-file: %v", configFile)
+	log.Debugf("fault-sound: %v", FaultSound)
+	log.Debugf("handler-timeout: %v", HandlerTimeout)
 	log.Debugf("inner-ring-size: %v", InnerRingSize)
+	log.Debug("listen-api-key: <redacted>")
 	log.Debugf("listen-address: %v", ListenAddress)
+	log.Debugf("listen-admin-api: %v", ListenAdminAPI)
 	log.Debugf("listen-port: %v", ListenPort)
+	log.Debugf("listen-tls-cert: %v", ListenTLSCert)
+	log.Debugf("listen-tls-client-ca: %v", ListenTLSClientCA)
+	log.Debugf("listen-tls-key: %v", ListenTLSKey)
 	log.Debugf("log-level: %v", level)
 	log.Debugf("log-report-caller: %v", logReportCaller)
 	log.Debugf("outer-ring-size: %v", OuterRingSize)
 	log.Debugf("permission: %v", Permission)
+	for _, step := range Pipeline {
+		log.Debugf("pipeline: %+v", step)
+	}
 	log.Debugf("read-sound: %v", ReadSound)
+	log.Debugf("reader-antenna-gain: %v", ReaderAntennaGain)
+	log.Debugf("reader-evdev-device: %v", ReaderEvdevDevice)
+	log.Debugf("reader-evdev-grab: %v", ReaderEvdevGrab)
+	log.Debugf("reader-evdev-uid-format: %v", ReaderEvdevUIDFormat)
+	log.Debugf("reader-i2c-address: %#02x", ReaderI2CAddress)
+	log.Debugf("reader-i2c-bus: %v", ReaderI2CBus)
+	log.Debugf("reader-irq-pin: %v", ReaderIRQPin)
+	log.Debugf("reader-pn532-interface: %v", ReaderPN532Interface)
+	log.Debugf("reader-poll-timeout: %v", ReaderPollTimeout)
+	log.Debugf("reader-read-tag-data: %v", ReaderReadTagData)
+	log.Debugf("reader-removal-polls: %v", ReaderRemovalPolls)
+	log.Debugf("reader-reset-pin: %v", ReaderResetPin)
+	log.Debugf("reader-simulated-source: %v", ReaderSimulatedSource)
+	log.Debugf("reader-spi-bus: %v", ReaderSPIBus)
+	log.Debugf("reader-spi-device: %v", ReaderSPIDevice)
+	log.Debugf("reader-spi-speed: %v", ReaderSPISpeed)
+	log.Debugf("reader-type: %v", ReaderType)
+	log.Debugf("reader-uart-baud: %v", ReaderUARTBaud)
+	log.Debugf("reader-uart-port: %v", ReaderUARTPort)
+	log.Debugf("reader-watchdog-interval: %v", ReaderWatchdogInterval)
+	log.Debugf("reader-watchdog-max-errors: %v", ReaderWatchdogMaxErrors)
+	log.Debugf("reader-watchdog-max-idle: %v", ReaderWatchdogMaxIdle)
+	for _, reader := range Readers {
+		log.Debugf("readers: %+v", reader)
+	}
 	log.Debugf("sound-dir: %v", SoundDir)
 	log.Debugf("unauthorized-sound: %v", UnauthorizedSound)
 	log.Debugf("volume-level: %v", VolumeLevel)
+	log.Debugf("web-waiters-suppress-handlers: %v", WebWaitersSuppressHandlers)
 }
 
 func validateLogLevel(level string, name string) (log.Level, error) {
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	pipelineKey = "pipeline"
+	handlerKey  = "handler"
+	policyKey   = "policy"
+	timeoutKey  = "timeout"
+)
+
+// The pipeline used when the config file doesn't have one
+var defaultPipeline = []string{"read-sound", "spin", "authorize", "stop-spin", "show-status", "auth-sound", "stop-status", "logging"}
+
+// Step is a single handler in the pipeline, the rest of the entry in the config file holds the handler
+// specific parameters
+type Step struct {
+	Handler string
+	// What happens when the handler fails (abort, continue or cleanup), "" for the handler's default
+	Policy string
+	// nil to use handler-timeout
+	Timeout *time.Duration
+	// The position of the step in the pipeline
+	Index  int
+	params yaml.MapSlice
+}
+
+// DecodeParams unmarshals the parameters of the step into params, any parameter which isn't a field
+// of params is an error
+func (s Step) DecodeParams(params interface{}) error {
+	out, err := yaml.Marshal(s.params)
+	if err != nil {
+		return s.Errorf("%v", err)
+	}
+	if err := yaml.UnmarshalStrict(out, params); err != nil {
+		return s.Errorf("%v", err)
+	}
+	return nil
+}
+
+// Errorf returns an error about the step in the same form as the other config errors
+func (s Step) Errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("invalid value for %v[%v] (%v): %v", pipelineKey, s.Index, s.Handler, fmt.Sprintf(format, a...))
+}
+
+// loadPipeline reads the pipeline section of configFile, if there isn't one the default pipeline is
+// returned. The handlers themselves are validated when the pipeline is built.
+func loadPipeline(configFile string) ([]Step, error) {
+	var raw struct {
+		Pipeline []yaml.MapSlice `yaml:"pipeline"`
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid value for %v in '%v': %v", pipelineKey, configFile, err)
+	}
+
+	if len(raw.Pipeline) == 0 {
+		steps := make([]Step, 0, len(defaultPipeline))
+		for i, handler := range defaultPipeline {
+			steps = append(steps, Step{Handler: handler, Index: i})
+		}
+		return steps, nil
+	}
+
+	steps := make([]Step, 0, len(raw.Pipeline))
+	for i, item := range raw.Pipeline {
+		step := Step{Index: i, params: make(yaml.MapSlice, 0, len(item))}
+		for _, entry := range item {
+			switch entry.Key {
+			case handlerKey, policyKey:
+				value, ok := entry.Value.(string)
+				if !ok {
+					return nil, fmt.Errorf("invalid value for %v[%v] in '%v': %v must be a string", pipelineKey, i, configFile, entry.Key)
+				}
+				if entry.Key == handlerKey {
+					step.Handler = value
+				} else {
+					step.Policy = value
+				}
+			case timeoutKey:
+				// Formatted rather than asserted so 0 doesn't need quoting
+				timeout, err := time.ParseDuration(fmt.Sprint(entry.Value))
+				if err != nil || timeout < 0 {
+					return nil, fmt.Errorf("invalid value for %v[%v] in '%v': %v must be a duration which isn't negative (e.g. 5s)", pipelineKey, i, configFile, timeoutKey)
+				}
+				step.Timeout = &timeout
+			default:
+				step.params = append(step.params, entry)
+			}
+		}
+		if step.Handler == "" {
+			return nil, fmt.Errorf("invalid value for %v[%v] in '%v': %v is required", pipelineKey, i, configFile, handlerKey)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPipeline(t *testing.T) {
+	fiveSeconds := 5 * time.Second
+	zero := time.Duration(0)
+	defaultSteps := make([]Step, 0, len(defaultPipeline))
+	for i, handler := range defaultPipeline {
+		defaultSteps = append(defaultSteps, Step{Handler: handler, Index: i})
+	}
+
+	tests := []struct {
+		name string
+		// "" means the config file doesn't exist
+		config  string
+		want    []Step
+		wantErr string
+	}{
+		{
+			name: "no config file",
+			want: defaultSteps,
+		},
+		{
+			name:   "no pipeline section",
+			config: "api-url: https://localhost:5000\n",
+			want:   defaultSteps,
+		},
+		{
+			name:   "policy and timeouts",
+			config: "pipeline:\n  - handler: authorize\n    policy: continue\n    timeout: 5s\n  - handler: logging\n    timeout: 0\n",
+			want: []Step{
+				{Handler: "authorize", Policy: "continue", Timeout: &fiveSeconds, Index: 0},
+				{Handler: "logging", Timeout: &zero, Index: 1},
+			},
+		},
+		{
+			name:    "negative timeout",
+			config:  "pipeline:\n  - handler: authorize\n    timeout: -1s\n",
+			wantErr: "invalid value for pipeline[0]",
+		},
+		{
+			name:    "invalid timeout",
+			config:  "pipeline:\n  - handler: authorize\n    timeout: soon\n",
+			wantErr: "must be a duration",
+		},
+		{
+			name:    "missing handler",
+			config:  "pipeline:\n  - policy: abort\n",
+			wantErr: "handler is required",
+		},
+		{
+			name:    "policy isn't a string",
+			config:  "pipeline:\n  - handler: authorize\n    policy: [abort]\n",
+			wantErr: "policy must be a string",
+		},
+		{
+			name:    "not a list",
+			config:  "pipeline: authorize\n",
+			wantErr: "invalid value for pipeline",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configFile := path.Join(t.TempDir(), "config.yaml")
+			if test.config != "" {
+				if err := os.WriteFile(configFile, []byte(test.config), 0600); err != nil {
+					t.Fatalf("unable to write %v: %v", configFile, err)
+				}
+			}
+
+			steps, err := loadPipeline(configFile)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing '%v'", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadPipeline: %v", err)
+			}
+			// The params are checked by TestStepDecodeParams
+			for i := range steps {
+				steps[i].params = nil
+			}
+			if !reflect.DeepEqual(steps, test.want) {
+				t.Errorf("got %+v, want %+v", steps, test.want)
+			}
+		})
+	}
+}
+
+func TestStepDecodeParams(t *testing.T) {
+	type params struct {
+		Color string `yaml:"color"`
+		Width *int   `yaml:"width"`
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		want    params
+		wantErr string
+	}{
+		{
+			name:   "no params",
+			config: "pipeline:\n  - handler: spin\n",
+		},
+		{
+			name:   "params",
+			config: "pipeline:\n  - handler: spin\n    color: 00FF00\n    policy: continue\n",
+			want:   params{Color: "00FF00"},
+		},
+		{
+			name:    "unknown param",
+			config:  "pipeline:\n  - handler: spin\n    colour: 00FF00\n",
+			wantErr: "invalid value for pipeline[0] (spin)",
+		},
+		{
+			name:    "wrong type",
+			config:  "pipeline:\n  - handler: spin\n    width: wide\n",
+			wantErr: "invalid value for pipeline[0] (spin)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configFile := path.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(test.config), 0600); err != nil {
+				t.Fatalf("unable to write %v: %v", configFile, err)
+			}
+			steps, err := loadPipeline(configFile)
+			if err != nil {
+				t.Fatalf("loadPipeline: %v", err)
+			}
+
+			var got params
+			err = steps[0].DecodeParams(&got)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing '%v'", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeParams: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/peterbourgon/ff/v3/ffyaml"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultReaderID = "default"
+	readersKey      = "readers"
+)
+
+// Reader is the configuration of a single physical reader, any field not set in the config file
+// defaults to the value of the matching reader-xxx flag.
+type Reader struct {
+	ID              string `yaml:"id"`
+	Type            string `yaml:"type"`
+	Permission      string `yaml:"permission"`
+	SimulatedSource string `yaml:"simulated-source"`
+	SPIBus          int    `yaml:"spi-bus"`
+	SPIDevice       int    `yaml:"spi-device"`
+	SPISpeed        string `yaml:"spi-speed"`
+	ResetPin        string `yaml:"reset-pin"`
+	IRQPin          string `yaml:"irq-pin"`
+	AntennaGain     int    `yaml:"antenna-gain"`
+	ReadTagData     bool   `yaml:"read-tag-data"`
+	PN532Interface  string `yaml:"pn532-interface"`
+	I2CBus          string `yaml:"i2c-bus"`
+	I2CAddress      int    `yaml:"i2c-address"`
+	UARTPort        string `yaml:"uart-port"`
+	UARTBaud        int    `yaml:"uart-baud"`
+	EvdevDevice     string `yaml:"evdev-device"`
+	EvdevGrab       bool   `yaml:"evdev-grab"`
+	EvdevUIDFormat  string `yaml:"evdev-uid-format"`
+}
+
+// yamlParser is a ff.ConfigFileParser which hands everything except the structured sections (which
+// ff can't represent as flags) to ffyaml, the structured sections are loaded separately.
+func yamlParser(r io.Reader, set func(name, value string) error) error {
+	var m yaml.MapSlice
+	if err := yaml.NewDecoder(r).Decode(&m); err != nil && !errors.Is(err, io.EOF) {
+		return ffyaml.ParseError{Inner: err}
+	}
+
+	flat := make(yaml.MapSlice, 0, len(m))
+	for _, item := range m {
+		if item.Key == readersKey || item.Key == pipelineKey {
+			continue
+		}
+		flat = append(flat, item)
+	}
+
+	out, err := yaml.Marshal(flat)
+	if err != nil {
+		return ffyaml.ParseError{Inner: err}
+	}
+	return ffyaml.Parser(bytes.NewReader(out), set)
+}
+
+// loadReaders reads the readers section of configFile, if there isn't one a single reader is created
+// from the reader-xxx flags.
+func loadReaders(configFile string, defaults Reader) ([]Reader, error) {
+	defaults.ID = defaultReaderID
+
+	var raw struct {
+		Readers []yaml.MapSlice `yaml:"readers"`
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid value for %v in '%v': %v", readersKey, configFile, err)
+	}
+
+	if len(raw.Readers) == 0 {
+		return []Reader{defaults}, nil
+	}
+
+	readers := make([]Reader, 0, len(raw.Readers))
+	ids := make(map[string]bool)
+	for i, item := range raw.Readers {
+		// Round trip each entry so it's unmarshaled over the top of the defaults
+		out, err := yaml.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		reader := defaults
+		reader.ID = ""
+		if err := yaml.UnmarshalStrict(out, &reader); err != nil {
+			return nil, fmt.Errorf("invalid value for %v[%v] in '%v': %v", readersKey, i, configFile, err)
+		}
+
+		if reader.ID == "" {
+			return nil, fmt.Errorf("invalid value for %v[%v] in '%v': id is required", readersKey, i, configFile)
+		}
+		if ids[reader.ID] {
+			return nil, fmt.Errorf("invalid value for %v[%v] in '%v': id '%v' is used by more than one reader", readersKey, i, configFile, reader.ID)
+		}
+		ids[reader.ID] = true
+		readers = append(readers, reader)
+	}
+	return readers, nil
+}
@@ -1,9 +1,16 @@
 package context
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+
 	log "github.com/sirupsen/logrus"
 
 	"github.com/bcurnow/magicband-reader/audio"
+	"github.com/bcurnow/magicband-reader/audit"
 	"github.com/bcurnow/magicband-reader/config"
 	"github.com/bcurnow/magicband-reader/led"
 	"github.com/bcurnow/magicband-reader/rfidsecuritysvc"
@@ -12,33 +19,66 @@ import (
 var (
 	AudioController audio.Controller
 	AudioCache      audio.Cache
+	// nil unless the pipeline has an audit step
+	AuditOutbox     audit.Outbox
 	RFIDSecuritySvc rfidsecuritysvc.Service
 	LEDController   led.Controller
 	Permission      string
-	State           map[string]interface{}
+	Permissions     map[string]string
 )
 
 func init() {
+	// There's no hardware or rfid-security-svc in the tests, they set up what they need themselves
+	if testing.Testing() {
+		return
+	}
 	log.Debug("Initializing Context")
 
-	service, err := rfidsecuritysvc.New(config.ApiKey, config.ApiSSLVerify, config.ApiUrl)
+	service, err := rfidsecuritysvc.New(rfidsecuritysvc.Config{
+		APIKey:            config.ApiKey,
+		SSLVerify:         config.ApiSSLVerify,
+		TLSClientCertFile: config.ApiTLSClientCert,
+		TLSClientKeyFile:  config.ApiTLSClientKey,
+		TLSServerName:     config.ApiTLSServerName,
+		URL:               config.ApiUrl,
+		Timeout:           config.ApiTimeout,
+		SyncTimeout:       config.ApiSyncTimeout,
+		Retries:           config.ApiRetries,
+		RetryBackoff:      config.ApiRetryBackoff,
+		SendTagData:       config.ApiSendTagData,
+		BreakerThreshold:  config.ApiBreakerThreshold,
+		BreakerCooldown:   config.ApiBreakerCooldown,
+	})
 	if err != nil {
 		panic(err)
 	}
 	RFIDSecuritySvc = service
 
+	// The outbox retries in the background and owns a directory, there's no need for either without an audit step
+	if pipelineHas("audit") {
+		auditOutbox, err := audit.NewOutbox(RFIDSecuritySvc, config.AuditOutboxDir, config.AuditRetryInterval, config.AuditOutboxMaxEvents)
+		if err != nil {
+			panic(err)
+		}
+		AuditOutbox = auditOutbox
+	}
+
 	audioCache, err := audio.NewCache(RFIDSecuritySvc, config.SoundDir)
 	if err != nil {
 		panic(err)
 	}
 
-	// Before we hand the cache over to any other object, make sure we've synced up
-	if err := audioCache.Sync(); err != nil {
+	// Before we hand the cache over to any other object, make sure we've synced up. Downloading the sounds can
+	// take a while so a signal aborts it rather than waiting for it to finish.
+	syncCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT)
+	err = audioCache.Sync(syncCtx)
+	stop()
+	if err != nil {
 		panic(err)
 	}
 	AudioCache = audioCache
 
-	audioController, err := audio.NewController(config.VolumeLevel, 0, audioCache, config.AuthorizedSound, config.ReadSound, config.UnauthorizedSound)
+	audioController, err := audio.NewController(config.VolumeLevel, 0, audioCache, config.AuthorizedSound, config.ReadSound, config.UnauthorizedSound, config.FaultSound)
 	if err != nil {
 		panic(err)
 	}
@@ -50,19 +90,40 @@ func init() {
 	}
 	LEDController = ledController
 
-	State = make(map[string]interface{})
 	// The permission is really part of the context for the application, this also
 	// reduces the direct dependencies on config
 	Permission = config.Permission
+	Permissions = make(map[string]string)
+	for _, reader := range config.Readers {
+		Permissions[reader.ID] = reader.Permission
+	}
+}
+
+// PermissionFor returns the permission to validate for reads from readerID, falling back to the
+// default permission for readers that don't have their own
+func PermissionFor(readerID string) string {
+	if permission, exists := Permissions[readerID]; exists && permission != "" {
+		return permission
+	}
+	return Permission
+}
+
+// pipelineHas returns true if handler is one of the steps in the pipeline
+func pipelineHas(handler string) bool {
+	for _, step := range config.Pipeline {
+		if step.Handler == handler {
+			return true
+		}
+	}
+	return false
 }
 
 func Close() error {
 	log.Debug("Closing context")
 	LEDController.Close()
+	if AuditOutbox != nil {
+		AuditOutbox.Close()
+	}
 	log.Trace("context closed")
 	return nil
 }
-
-func ClearState(key string) {
-	delete(State, key)
-}
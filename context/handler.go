@@ -3,6 +3,8 @@ package context
 import (
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -10,30 +12,83 @@ import (
 )
 
 type Handler interface {
-	Handle(event event.Event) error
+	// Handle handles a single step for event, pc holds the state shared with the other steps for this event
+	Handle(pc *PipelineContext, event event.Event) error
+}
+
+// Policy is what happens to the rest of the pipeline when a handler fails (returns an error, panics or
+// times out)
+type Policy int
+
+const (
+	// The rest of the pipeline is skipped, except for the CLEANUP handlers
+	ABORT Policy = iota
+	// The error is logged and the pipeline carries on
+	CONTINUE
+	// Like CONTINUE but the handler also runs after another handler aborted the pipeline
+	CLEANUP
+)
+
+var policies = map[Policy]string{
+	ABORT:    "abort",
+	CONTINUE: "continue",
+	CLEANUP:  "cleanup",
+}
+
+func (p Policy) String() string {
+	return policies[p]
+}
+
+// ParsePolicy returns the Policy with the name policy (e.g. "abort")
+func ParsePolicy(policy string) (Policy, error) {
+	for p, name := range policies {
+		if name == policy {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown policy '%v', must be one of: %v", policy, strings.Join([]string{ABORT.String(), CONTINUE.String(), CLEANUP.String()}, ", "))
+}
+
+// Registration is a handler along with how the pipeline runs it
+type Registration struct {
+	Handler Handler
+	Policy  Policy
+	// How long the handler can run before it's considered failed, 0 means no limit
+	Timeout time.Duration
 }
 
 var (
-	Handlers map[int]Handler
+	Handlers map[int]Registration
 )
 
 func init() {
 	log.Debug("Initializing Handlers")
-	Handlers = make(map[int]Handler)
+	Handlers = make(map[int]Registration)
 }
 
-func RegisterHandler(priority int, handler Handler) error {
-	existingHandler, exists := Handlers[priority]
+func RegisterHandler(priority int, registration Registration) error {
+	existing, exists := Handlers[priority]
 
 	if exists {
-		return fmt.Errorf("handler '%T' already registered with priority %v", existingHandler, priority)
+		return fmt.Errorf("handler '%T' already registered with priority %v", existing.Handler, priority)
 	}
-	Handlers[priority] = handler
-	log.Debugf("Handler '%T' registered with priority %v", handler, priority)
+	Handlers[priority] = registration
+	log.Debugf("Handler '%T' registered with priority %v (policy: %v, timeout: %v)", registration.Handler, priority, registration.Policy, registration.Timeout)
 	return nil
 }
 
-func SortedHandlers() []Handler {
+func SortedHandlers() []Registration {
+	keys := SortedPriorities()
+
+	sorted := make([]Registration, 0, len(Handlers))
+	for _, key := range keys {
+		sorted = append(sorted, Handlers[key])
+	}
+	return sorted
+}
+
+// SortedPriorities returns the priorities of the registered handlers in the order they're run
+func SortedPriorities() []int {
 	keys := make([]int, 0, len(Handlers))
 
 	for key := range Handlers {
@@ -41,10 +96,5 @@ func SortedHandlers() []Handler {
 	}
 
 	sort.Ints(keys)
-
-	sorted := make([]Handler, 0, len(Handlers))
-	for _, key := range keys {
-		sorted = append(sorted, Handlers[key])
-	}
-	return sorted
+	return keys
 }
@@ -0,0 +1,180 @@
+package context
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bcurnow/magicband-reader/rfidsecuritysvc"
+)
+
+// Task names work the handlers run in the background while the rest of the pipeline carries on
+type Task string
+
+type asyncTask struct {
+	// Closed to ask the task to stop, tasks which always run to completion ignore it
+	stop chan bool
+	// Closed once the task has finished
+	done     chan bool
+	stopOnce sync.Once
+}
+
+// PipelineContext holds the state the handlers share while a single event is handled. It's created for
+// each event and discarded once the pipeline has finished, so nothing from one event leaks into the next.
+// Each handler gets its own PipelineContext from ForHandler, they share the state but not the context.
+type PipelineContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	*pipelineState
+}
+
+type pipelineState struct {
+	mediaConfig *rfidsecuritysvc.MediaConfig
+	tasks       map[Task]*asyncTask
+	closed      bool
+	lock        sync.Mutex
+}
+
+// NewPipelineContext creates the context for a single event, cancelling ctx (e.g. when we're shutting down)
+// cancels the calls the handlers make to other services
+func NewPipelineContext(ctx context.Context) *PipelineContext {
+	ctx, cancel := context.WithCancel(ctx)
+	return &PipelineContext{ctx: ctx, cancel: cancel, pipelineState: &pipelineState{tasks: make(map[Task]*asyncTask)}}
+}
+
+// ForHandler returns the PipelineContext for a single handler, calling cancel (e.g. because the handler
+// timed out) cancels the handler's context without affecting the rest of the pipeline
+func (p *PipelineContext) ForHandler() (pc *PipelineContext, cancel context.CancelFunc) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	return &PipelineContext{ctx: ctx, cancel: cancel, pipelineState: p.pipelineState}, cancel
+}
+
+// Context returns the context the handlers pass to other services and watch while they wait, it's
+// cancelled if the handler times out and once the pipeline has finished
+func (p *PipelineContext) Context() context.Context {
+	return p.ctx
+}
+
+// MediaConfig returns the media config of an authorized band, nil if the band hasn't been authorized
+func (p *PipelineContext) MediaConfig() *rfidsecuritysvc.MediaConfig {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.mediaConfig
+}
+
+func (p *PipelineContext) SetMediaConfig(mediaConfig *rfidsecuritysvc.MediaConfig) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.mediaConfig = mediaConfig
+}
+
+// RunAsync runs f in the background as task, f should return once stop is closed if it doesn't finish on
+// its own. If task is already running it's waited for first. A panic in f is logged rather than taking
+// down the process. Nothing is started once the context is done.
+func (p *PipelineContext) RunAsync(task Task, f func(stop <-chan bool)) {
+	if p.task(task) != nil {
+		// Nothing in the pipeline waited for the last run, it has to finish before it's replaced
+		log.Debugf("RunAsync: '%v' from an earlier step wasn't waited for, waiting", task)
+		if err := p.WaitForAsync(task); err != nil {
+			log.Warnf("RunAsync: '%v' not started: %v", task, err)
+			return
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed || p.ctx.Err() != nil {
+		// A handler which timed out carried on
+		log.Warnf("RunAsync: '%v' started after the handler was cancelled, ignoring", task)
+		return
+	}
+	t := &asyncTask{stop: make(chan bool), done: make(chan bool)}
+	p.tasks[task] = t
+	go func() {
+		defer close(t.done)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("RunAsync: '%v' panicked: %v\n%s", task, r, debug.Stack())
+			}
+		}()
+		f(t.stop)
+	}()
+}
+
+// WaitForAsync waits for task to finish, it returns straight away if task isn't running (e.g. the step
+// which starts it isn't in the pipeline). An error means the context was done before task finished.
+func (p *PipelineContext) WaitForAsync(task Task) error {
+	t := p.task(task)
+	if t == nil {
+		return nil
+	}
+	select {
+	case <-t.done:
+	case <-p.ctx.Done():
+		return fmt.Errorf("gave up waiting for '%v': %w", task, p.ctx.Err())
+	}
+	p.remove(task, t)
+	return nil
+}
+
+// StopAsync asks task to stop and waits for it to finish. An error means the context was done before
+// task finished, it's still been asked to stop.
+func (p *PipelineContext) StopAsync(task Task) error {
+	t := p.task(task)
+	if t == nil {
+		return nil
+	}
+	t.requestStop()
+	select {
+	case <-t.done:
+	case <-p.ctx.Done():
+		return fmt.Errorf("gave up waiting for '%v' to stop: %w", task, p.ctx.Err())
+	}
+	p.remove(task, t)
+	return nil
+}
+
+// Close stops and waits for any tasks which are still running and cancels the context, it's called once the
+// pipeline has finished. Unlike StopAsync it waits even if the context is already done (e.g. we're
+// shutting down), the tasks must not outlive the pipeline.
+func (p *PipelineContext) Close() {
+	defer p.cancel()
+	p.lock.Lock()
+	p.closed = true
+	tasks := make(map[Task]*asyncTask, len(p.tasks))
+	for task, t := range p.tasks {
+		tasks[task] = t
+	}
+	p.lock.Unlock()
+	for task, t := range tasks {
+		log.Debugf("Close: '%v' is still running at the end of the pipeline, stopping", task)
+		t.requestStop()
+		<-t.done
+		p.remove(task, t)
+	}
+}
+
+func (p *PipelineContext) task(task Task) *asyncTask {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.tasks[task]
+}
+
+// remove forgets task as long as it hasn't been replaced by a newer run
+func (p *PipelineContext) remove(task Task, t *asyncTask) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.tasks[task] == t {
+		delete(p.tasks, task)
+	}
+}
+
+// requestStop closes stop, it's safe to call more than once
+func (t *asyncTask) requestStop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+}
@@ -0,0 +1,80 @@
+package context
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testTask Task = "test"
+
+func TestWaitForAsyncCancelled(t *testing.T) {
+	pc := NewPipelineContext(context.Background())
+	release := make(chan bool)
+	pc.RunAsync(testTask, func(stop <-chan bool) {
+		<-release
+	})
+
+	handlerPC, cancel := pc.ForHandler()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := handlerPC.WaitForAsync(testTask); !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitForAsync: got %v, want %v", err, context.Canceled)
+	}
+	if pc.Context().Err() != nil {
+		t.Error("cancelling the handler cancelled the pipeline")
+	}
+
+	// The task is still there for the rest of the pipeline
+	close(release)
+	if err := pc.WaitForAsync(testTask); err != nil {
+		t.Errorf("WaitForAsync: unexpected error: %v", err)
+	}
+	pc.Close()
+}
+
+func TestStopAsyncCancelled(t *testing.T) {
+	pc := NewPipelineContext(context.Background())
+	stopped := make(chan bool)
+	release := make(chan bool)
+	pc.RunAsync(testTask, func(stop <-chan bool) {
+		<-stop
+		close(stopped)
+		<-release
+	})
+
+	handlerPC, cancel := pc.ForHandler()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := handlerPC.StopAsync(testTask); !errors.Is(err, context.Canceled) {
+		t.Errorf("StopAsync: got %v, want %v", err, context.Canceled)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the task wasn't asked to stop")
+	}
+	close(release)
+	pc.Close()
+}
+
+func TestCloseWaitsAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pc := NewPipelineContext(ctx)
+	finished := false
+	pc.RunAsync(testTask, func(stop <-chan bool) {
+		<-stop
+		time.Sleep(10 * time.Millisecond)
+		finished = true
+	})
+
+	// e.g. we're shutting down
+	cancel()
+	pc.Close()
+	if !finished {
+		t.Error("Close returned before the task finished")
+	}
+
+	pc.RunAsync(testTask, func(stop <-chan bool) {
+		t.Error("a task was started after Close")
+	})
+}
@@ -2,36 +2,91 @@ package event
 
 import (
 	"fmt"
+	"sync"
+	"time"
 )
 
 type Event interface {
 	fmt.Stringer
 	UID() string
+	ReaderID() string
+	// When the band was read
+	Timestamp() time.Time
 	Type() EventType
 	SetType(EventType)
+	// Why the event is UNAUTHORIZED, NO_REASON otherwise
+	Reason() Reason
+	SetReason(Reason)
+	// Tag is nil unless the reader was configured to read tag data and supports it
+	Tag() *Tag
+	SetTag(*Tag)
 }
 
 type event struct {
+	readerID  string
 	uid       string
+	timestamp time.Time
 	eventType EventType
+	reason    Reason
+	tag       *Tag
+	// A handler which timed out may still update the event while the rest of the pipeline reads it
+	lock sync.RWMutex
 }
 
-func NewEvent(uid string, eventType EventType) Event {
-	return &event{uid: uid, eventType: eventType}
+func NewEvent(readerID string, uid string, eventType EventType) Event {
+	return &event{readerID: readerID, uid: uid, timestamp: time.Now(), eventType: eventType}
+}
+
+func (e *event) ReaderID() string {
+	return e.readerID
 }
 
 func (e *event) UID() string {
 	return e.uid
 }
 
+func (e *event) Timestamp() time.Time {
+	return e.timestamp
+}
+
 func (e *event) Type() EventType {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
 	return e.eventType
 }
 
 func (e *event) SetType(eventType EventType) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
 	e.eventType = eventType
 }
 
+func (e *event) Reason() Reason {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.reason
+}
+
+func (e *event) SetReason(reason Reason) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.reason = reason
+}
+
+func (e *event) Tag() *Tag {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.tag
+}
+
+func (e *event) SetTag(tag *Tag) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.tag = tag
+}
+
 func (e *event) String() string {
-	return fmt.Sprintf("&event.event{uid:\"%v\", eventType:%v}", e.uid, e.eventType.String())
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return fmt.Sprintf("&event.event{readerID:\"%v\", uid:\"%v\", timestamp:%v, eventType:%v, reason:%v, tag:%v}", e.readerID, e.uid, e.timestamp.Format(time.RFC3339Nano), e.eventType.String(), e.reason.String(), e.tag)
 }
@@ -0,0 +1,30 @@
+package event
+
+import (
+	"fmt"
+)
+
+// Tag is what was read from the tag besides the UID, it's only available from readers which support it
+type Tag struct {
+	// A description of the type of tag (e.g. NTAG215) based on the ATQA, SAK and capability container
+	Type string `json:"type"`
+	// The ATQA (answer to request) and SAK (select acknowledge) reported by the tag
+	ATQA uint16 `json:"atqa"`
+	SAK  byte   `json:"sak"`
+	// The raw user memory (NTAG/MIFARE Ultralight only), starting at page 4
+	Memory []byte `json:"memory,omitempty"`
+	// The NDEF records found in the user memory
+	NDEF []NDEFRecord `json:"ndef,omitempty"`
+}
+
+type NDEFRecord struct {
+	// The Type Name Format, describes how to interpret Type
+	TNF     byte   `json:"tnf"`
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Payload []byte `json:"payload"`
+}
+
+func (t *Tag) String() string {
+	return fmt.Sprintf("&event.Tag{Type:\"%v\", ATQA:%#04x, SAK:%#02x, Memory:%v bytes, NDEF:%v records}", t.Type, t.ATQA, t.SAK, len(t.Memory), len(t.NDEF))
+}
@@ -17,3 +17,37 @@ var toString = map[EventType]string{
 func (et EventType) String() string {
 	return toString[et]
 }
+
+// Reason explains why an event is UNAUTHORIZED, so a band which was rejected can be told apart from one
+// which couldn't be checked
+type Reason int
+
+const (
+	// The event isn't UNAUTHORIZED
+	NO_REASON Reason = iota
+	// rfid-security-svc rejected the band
+	DENIED
+	// rfid-security-svc doesn't know the band
+	UNKNOWN_MEDIA
+	// rfid-security-svc couldn't be reached or failed
+	SERVICE_ERROR
+	// rfid-security-svc didn't respond in time
+	TIMEOUT
+)
+
+var reasonToString = map[Reason]string{
+	NO_REASON:     "",
+	DENIED:        "DENIED",
+	UNKNOWN_MEDIA: "UNKNOWN_MEDIA",
+	SERVICE_ERROR: "SERVICE_ERROR",
+	TIMEOUT:       "TIMEOUT",
+}
+
+func (r Reason) String() string {
+	return reasonToString[r]
+}
+
+// IsFault returns true if the band wasn't rejected but couldn't be checked because something is broken
+func (r Reason) IsFault() bool {
+	return r == SERVICE_ERROR || r == TIMEOUT
+}
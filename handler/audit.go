@@ -0,0 +1,33 @@
+package handler
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bcurnow/magicband-reader/audit"
+	"github.com/bcurnow/magicband-reader/config"
+	"github.com/bcurnow/magicband-reader/context"
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+type Audit struct{}
+
+func NewAudit(step config.Step) (context.Handler, error) {
+	if err := noParams(step); err != nil {
+		return nil, err
+	}
+	return &Audit{}, nil
+}
+
+func (h *Audit) Handle(pc *context.PipelineContext, e event.Event) error {
+	auditEvent, err := audit.NewEvent(e, context.PermissionFor(e.ReaderID()))
+	if err != nil {
+		return err
+	}
+	log.Tracef("Auditing %+v", auditEvent)
+	return context.AuditOutbox.Send(auditEvent)
+}
+
+func init() {
+	// Every read is audited, even if the pipeline was aborted
+	register("audit", NewAudit, context.CLEANUP)
+}
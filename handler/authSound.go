@@ -4,45 +4,80 @@ import (
 	"github.com/gopxl/beep/v2"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/bcurnow/magicband-reader/config"
 	"github.com/bcurnow/magicband-reader/context"
 	"github.com/bcurnow/magicband-reader/event"
-	"github.com/bcurnow/magicband-reader/rfidsecuritysvc"
 )
 
 type AuthSound struct {
 	authSound   *beep.Buffer
 	unauthSound *beep.Buffer
+	faultSound  *beep.Buffer
 }
 
-func (h *AuthSound) Handle(e event.Event) error {
+type authSoundParams struct {
+	// Played when the media config of the band doesn't have a sound, defaults to authorized-sound
+	AuthorizedSound string `yaml:"authorized-sound"`
+	// Defaults to unauthorized-sound
+	UnauthorizedSound string `yaml:"unauthorized-sound"`
+	// Played when the band couldn't be checked, defaults to fault-sound
+	FaultSound string `yaml:"fault-sound"`
+}
+
+func NewAuthSound(step config.Step) (context.Handler, error) {
+	var params authSoundParams
+	if err := step.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	authSound, err := soundParam(step, params.AuthorizedSound, context.AudioController.AuthorizedSound())
+	if err != nil {
+		return nil, err
+	}
+	unauthSound, err := soundParam(step, params.UnauthorizedSound, context.AudioController.UnauthorizedSound())
+	if err != nil {
+		return nil, err
+	}
+	faultSound, err := soundParam(step, params.FaultSound, context.AudioController.FaultSound())
+	if err != nil {
+		return nil, err
+	}
+	return &AuthSound{authSound: authSound, unauthSound: unauthSound, faultSound: faultSound}, nil
+}
+
+func (h *AuthSound) Handle(pc *context.PipelineContext, e event.Event) error {
 	log.Trace("Playing the auth sound")
 	switch e.Type() {
 	case event.AUTHORIZED:
-		return runAsync("authSoundPlaying", func() {
-			context.AudioController.Play(h.resolveSound())
+		sound := h.resolveSound(pc)
+		pc.RunAsync(authSoundPlaying, func(stop <-chan bool) {
+			context.AudioController.Play(sound)
 		})
 	case event.UNAUTHORIZED:
-		return runAsync("authSoundPlaying", func() {
-			context.AudioController.Play(h.unauthSound)
+		sound := h.unauthSound
+		if e.Reason().IsFault() {
+			sound = h.faultSound
+		}
+		pc.RunAsync(authSoundPlaying, func(stop <-chan bool) {
+			context.AudioController.Play(sound)
 		})
 	}
 	return nil
 }
 
-func (h *AuthSound) resolveSound() *beep.Buffer {
-	// Not sure how this would happen but we don't have a MediaConfig object in state
-	if context.State["mediaConfig"] == nil {
-		log.Warnf("Unable to find mediaConfig in State, using default authorized sound")
+func (h *AuthSound) resolveSound(pc *context.PipelineContext) *beep.Buffer {
+	mediaConfig := pc.MediaConfig()
+	// The pipeline doesn't authorize the band before this step
+	if mediaConfig == nil {
+		log.Warnf("No mediaConfig for the event, using default authorized sound")
 		return h.authSound
 	}
 
-	mediaConfig := context.State["mediaConfig"].(*rfidsecuritysvc.MediaConfig)
 	if mediaConfig.Sound == nil {
 		log.Debugf("No sound configured in mediaConfig, using default authorized sound")
 		return h.authSound
 	}
 
-	soundBuffer, err := context.AudioController.Load(mediaConfig.Sound)
+	soundBuffer, err := context.AudioController.Load(pc.Context(), mediaConfig.Sound)
 	if err != nil {
 		log.Warnf("Unable to load %v from mediaConfig, using default authorized sound", mediaConfig.Sound.Name)
 		return h.authSound
@@ -52,12 +87,5 @@ func (h *AuthSound) resolveSound() *beep.Buffer {
 }
 
 func init() {
-	handler := &AuthSound{
-		authSound:   context.AudioController.AuthorizedSound(),
-		unauthSound: context.AudioController.UnauthorizedSound(),
-	}
-
-	if err := context.RegisterHandler(21, handler); err != nil {
-		panic(err)
-	}
+	register("auth-sound", NewAuthSound, context.ABORT)
 }
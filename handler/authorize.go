@@ -1,30 +1,45 @@
 package handler
 
 import (
+	"fmt"
+
 	log "github.com/sirupsen/logrus"
 
+	"github.com/bcurnow/magicband-reader/config"
 	"github.com/bcurnow/magicband-reader/context"
 	"github.com/bcurnow/magicband-reader/event"
+	"github.com/bcurnow/magicband-reader/rfidsecuritysvc"
 )
 
-type Authorize struct {
-	permission string
+type Authorize struct{}
+
+func NewAuthorize(step config.Step) (context.Handler, error) {
+	if err := noParams(step); err != nil {
+		return nil, err
+	}
+	return &Authorize{}, nil
 }
 
-func (h *Authorize) Handle(e event.Event) error {
-	log.Tracef("Authenticating '%v'", e.UID())
-	if mediaConfig, err := context.RFIDSecuritySvc.Authorized(e, h.permission); err != nil {
+func (h *Authorize) Handle(pc *context.PipelineContext, e event.Event) error {
+	log.Tracef("Authenticating '%v' from reader '%v'", e.UID(), e.ReaderID())
+	if mediaConfig, err := context.RFIDSecuritySvc.AuthorizedContext(pc.Context(), e, context.PermissionFor(e.ReaderID())); err != nil {
+		if pc.Context().Err() != nil {
+			// The read was cancelled (e.g. we're shutting down), the band wasn't checked so it isn't denied or broken
+			return fmt.Errorf("authorization of '%v' cancelled: %w", e.UID(), err)
+		}
 		e.SetType(event.UNAUTHORIZED)
+		e.SetReason(rfidsecuritysvc.ReasonFor(err))
+		if e.Reason().IsFault() {
+			log.Errorf("Unable to authorize '%v' (%v): %v", e.UID(), e.Reason(), err)
+		}
 	} else {
 		e.SetType(event.AUTHORIZED)
-		context.State["mediaConfig"] = mediaConfig
+		pc.SetMediaConfig(mediaConfig)
 		log.Tracef("%+v", mediaConfig)
 	}
 	return nil
 }
 
 func init() {
-	if err := context.RegisterHandler(12, &Authorize{permission: context.Permission}); err != nil {
-		panic(err)
-	}
+	register("authorize", NewAuthorize, context.ABORT)
 }
@@ -1,48 +1,162 @@
 /*
- * The handler package contains all the various steps in the MagicBand reader flow, the general approach is to break the flow into sections
- * using a two digit number (e.g. priority 10 = section one, step zero, priority 11 = section one, step 1, priority 20 = section 2, step 0).
- * The current flow is broken down as follows:
+ * The handler package contains all the various steps in the MagicBand reader flow. Which handlers run, in what order
+ * and with what parameters is configured by the pipeline section of the config file, each handler is registered under
+ * a name by its own file. The default pipeline is broken down as follows:
  * Section One
- *   10 - readSound
- *   11 - spin
- *   12 - authorize
- *   13 - stopSpin
+ *   read-sound
+ *   spin
+ *   authorize
+ *   stop-spin
  * Section Two
- *   20 - showStatus
- *   21 - authSound
- *   22 - stopStatus
+ *   show-status
+ *   auth-sound
+ *   stop-status
  *
- * There is also a handler at priority math.MaxInt which is designed to be the last step and will log the results.
+ * The last step is logging which logs the results.
  */
 package handler
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/gopxl/beep/v2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bcurnow/magicband-reader/config"
 	"github.com/bcurnow/magicband-reader/context"
+	"github.com/bcurnow/magicband-reader/led"
 )
 
 const (
 	fadeEffectDelay = 10 * time.Millisecond
+
+	// The tasks the handlers run in the background
+	authSoundPlaying context.Task = "authSoundPlaying"
+	readSoundPlaying context.Task = "readSoundPlaying"
+	showingStatus    context.Task = "showStatus"
+	spinning         context.Task = "spinning"
 )
 
-func runAsync(channelName string, f func()) error {
-	if _, exists := context.State[channelName]; exists {
-		return fmt.Errorf("unable to runAsync, channel with name '%v' already exists in state: %v", channelName, context.State)
+// factory creates a handler from its step in the pipeline
+type factory func(step config.Step) (context.Handler, error)
+
+// registered is a handler which can be used in the pipeline
+type registered struct {
+	create factory
+	// Used when the step doesn't set a policy
+	policy context.Policy
+}
+
+var (
+	factories = make(map[string]registered)
+	// Handlers which must be followed by another, e.g. without stop-spin the spin carries on until the end of the pipeline
+	pairs = map[string]string{
+		"spin": "stop-spin",
 	}
+)
 
-	ch := make(chan bool)
-	go func() {
-		f()
-		close(ch)
-	}()
+func register(name string, f factory, policy context.Policy) {
+	if _, exists := factories[name]; exists {
+		panic(fmt.Sprintf("handler '%v' already registered", name))
+	}
+	factories[name] = registered{create: f, policy: policy}
+}
+
+// Configure creates the handlers in pipeline and registers them with the context in the order they're listed,
+// timeout applies to the steps which don't set their own
+func Configure(pipeline []config.Step, timeout time.Duration) error {
+	if err := validatePairs(pipeline); err != nil {
+		return err
+	}
+	for _, step := range pipeline {
+		r, exists := factories[step.Handler]
+		if !exists {
+			return step.Errorf("unknown handler, must be one of: %v", strings.Join(names(), ", "))
+		}
+		h, err := r.create(step)
+		if err != nil {
+			return err
+		}
+
+		registration := context.Registration{Handler: h, Policy: r.policy, Timeout: timeout}
+		if step.Policy != "" {
+			if registration.Policy, err = context.ParsePolicy(step.Policy); err != nil {
+				return step.Errorf("%v", err)
+			}
+		}
+		if step.Timeout != nil {
+			registration.Timeout = *step.Timeout
+		}
+		if err := context.RegisterHandler(step.Index, registration); err != nil {
+			return err
+		}
+	}
+	log.Debugf("Pipeline configured with %v handlers", len(pipeline))
+	return nil
+}
 
-	context.State[channelName] = ch
+// validatePairs makes sure every handler in pairs is followed by its partner, and every partner follows its handler
+func validatePairs(pipeline []config.Step) error {
+	for first, second := range pairs {
+		var open *config.Step
+		for _, step := range pipeline {
+			switch step.Handler {
+			case first:
+				if open != nil {
+					return open.Errorf("must be followed by %v before the next %v", second, first)
+				}
+				open = &step
+			case second:
+				if open == nil {
+					return step.Errorf("must follow %v", first)
+				}
+				open = nil
+			}
+		}
+		if open != nil {
+			return open.Errorf("must be followed by %v", second)
+		}
+	}
 	return nil
 }
 
-func waitForAsync(channelName string) {
-	<-context.State[channelName].(chan bool)
-	context.ClearState(channelName)
+func names() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// noParams validates that step doesn't have any parameters
+func noParams(step config.Step) error {
+	return step.DecodeParams(&struct{}{})
+}
+
+// colorParam parses the color parameter of step, using defaultColor if it's not set
+func colorParam(step config.Step, color string, defaultColor led.Color) (led.Color, error) {
+	if color == "" {
+		return defaultColor, nil
+	}
+	parsed, err := led.ParseColor(color)
+	if err != nil {
+		return 0, step.Errorf("%v", err)
+	}
+	return parsed, nil
+}
+
+// soundParam loads the sound parameter of step from the sound cache, using defaultSound if it's not set
+func soundParam(step config.Step, soundName string, defaultSound *beep.Buffer) (*beep.Buffer, error) {
+	if soundName == "" {
+		return defaultSound, nil
+	}
+	sound, err := context.AudioController.LoadCached(soundName)
+	if err != nil {
+		return nil, step.Errorf("unable to load sound '%v': %v", soundName, err)
+	}
+	return sound, nil
 }
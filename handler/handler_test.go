@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcurnow/magicband-reader/config"
+	"github.com/bcurnow/magicband-reader/context"
+)
+
+func TestConfigure(t *testing.T) {
+	oneSecond := time.Second
+	tests := []struct {
+		name     string
+		pipeline []config.Step
+		// The policy and timeout of each registered step, by priority
+		want    map[int]context.Registration
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			pipeline: []config.Step{
+				{Handler: "logging", Index: 0},
+			},
+			want: map[int]context.Registration{0: {Policy: context.CLEANUP, Timeout: 5 * time.Second}},
+		},
+		{
+			name: "policy and timeout",
+			pipeline: []config.Step{
+				{Handler: "logging", Policy: "abort", Timeout: &oneSecond, Index: 0},
+			},
+			want: map[int]context.Registration{0: {Policy: context.ABORT, Timeout: time.Second}},
+		},
+		{
+			name: "unknown handler",
+			pipeline: []config.Step{
+				{Handler: "open-door", Index: 0},
+			},
+			wantErr: "invalid value for pipeline[0] (open-door): unknown handler",
+		},
+		{
+			name: "unknown policy",
+			pipeline: []config.Step{
+				{Handler: "logging", Policy: "ignore", Index: 0},
+			},
+			wantErr: "invalid value for pipeline[0] (logging): unknown policy 'ignore'",
+		},
+		{
+			name: "spin without stop-spin",
+			pipeline: []config.Step{
+				{Handler: "spin", Index: 0},
+				{Handler: "logging", Index: 1},
+			},
+			wantErr: "invalid value for pipeline[0] (spin): must be followed by stop-spin",
+		},
+		{
+			name: "stop-spin without spin",
+			pipeline: []config.Step{
+				{Handler: "stop-spin", Index: 0},
+			},
+			wantErr: "invalid value for pipeline[0] (stop-spin): must follow spin",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			context.Handlers = make(map[int]context.Registration)
+			err := Configure(test.pipeline, 5*time.Second)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing '%v'", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Configure: %v", err)
+			}
+			if len(context.Handlers) != len(test.want) {
+				t.Fatalf("got %v handlers, want %v", len(context.Handlers), len(test.want))
+			}
+			for priority, want := range test.want {
+				got := context.Handlers[priority]
+				if got.Policy != want.Policy || got.Timeout != want.Timeout {
+					t.Errorf("handler %v: got policy %v and timeout %v, want %v and %v", priority, got.Policy, got.Timeout, want.Policy, want.Timeout)
+				}
+			}
+		})
+	}
+}
@@ -3,35 +3,39 @@ package handler
 import (
 	log "github.com/sirupsen/logrus"
 
+	"github.com/bcurnow/magicband-reader/config"
 	"github.com/bcurnow/magicband-reader/context"
 	"github.com/bcurnow/magicband-reader/event"
 )
 
-const (
-	// TODO this should really be math.MaxInt but that constant wasn't introduced until golang 1.17
-	maxInt = int(^uint(0) >> 1)
-)
+type Logging struct{}
 
-type Logging struct {
-	permission string
+func NewLogging(step config.Step) (context.Handler, error) {
+	if err := noParams(step); err != nil {
+		return nil, err
+	}
+	return &Logging{}, nil
 }
 
-func (h *Logging) Handle(e event.Event) error {
+func (h *Logging) Handle(pc *context.PipelineContext, e event.Event) error {
 	log.Debug(e.String())
+	permission := context.PermissionFor(e.ReaderID())
 
 	switch e.Type() {
 	case event.UNKNOWN:
 		log.Errorf("Received an unknown event: %v", e.String())
 	case event.AUTHORIZED:
-		log.Infof("%v was authorized for '%v'", e.UID(), h.permission)
+		log.Infof("%v was authorized for '%v' on reader '%v'", e.UID(), permission, e.ReaderID())
 	case event.UNAUTHORIZED:
-		log.Warnf("%v was NOT authorized for '%v'", e.UID(), h.permission)
+		if e.Reason().IsFault() {
+			log.Errorf("%v could NOT be checked for '%v' on reader '%v' (%v)", e.UID(), permission, e.ReaderID(), e.Reason())
+			break
+		}
+		log.Warnf("%v was NOT authorized for '%v' on reader '%v' (%v)", e.UID(), permission, e.ReaderID(), e.Reason())
 	}
 	return nil
 }
 
 func init() {
-	if err := context.RegisterHandler(maxInt, &Logging{permission: context.Permission}); err != nil {
-		panic(err)
-	}
+	register("logging", NewLogging, context.CLEANUP)
 }
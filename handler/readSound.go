@@ -4,6 +4,7 @@ import (
 	"github.com/gopxl/beep/v2"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/bcurnow/magicband-reader/config"
 	"github.com/bcurnow/magicband-reader/context"
 	"github.com/bcurnow/magicband-reader/event"
 )
@@ -12,19 +13,31 @@ type ReadSound struct {
 	sound *beep.Buffer
 }
 
-func (h *ReadSound) Handle(e event.Event) error {
+type readSoundParams struct {
+	// The sound played when a band is read, defaults to read-sound
+	Sound string `yaml:"sound"`
+}
+
+func NewReadSound(step config.Step) (context.Handler, error) {
+	var params readSoundParams
+	if err := step.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	sound, err := soundParam(step, params.Sound, context.AudioController.ReadSound())
+	if err != nil {
+		return nil, err
+	}
+	return &ReadSound{sound: sound}, nil
+}
+
+func (h *ReadSound) Handle(pc *context.PipelineContext, e event.Event) error {
 	log.Trace("Playing the read sound")
-	return runAsync("readSoundPlaying", func() {
+	pc.RunAsync(readSoundPlaying, func(stop <-chan bool) {
 		context.AudioController.Play(h.sound)
 	})
+	return nil
 }
 
 func init() {
-	handler := &ReadSound{
-		sound: context.AudioController.ReadSound(),
-	}
-
-	if err := context.RegisterHandler(10, handler); err != nil {
-		panic(err)
-	}
+	register("read-sound", NewReadSound, context.ABORT)
 }
@@ -1,8 +1,11 @@
 package handler
 
 import (
+	"time"
+
 	log "github.com/sirupsen/logrus"
 
+	"github.com/bcurnow/magicband-reader/config"
 	"github.com/bcurnow/magicband-reader/context"
 	"github.com/bcurnow/magicband-reader/event"
 	"github.com/bcurnow/magicband-reader/led"
@@ -10,23 +13,72 @@ import (
 )
 
 const (
-	defaultAuthColor = led.GREEN
+	defaultAuthColor   = led.GREEN
+	defaultUnauthColor = led.BLUE
+	defaultFaultColor  = led.ORANGE
 )
 
-type ShowStatus struct{}
+type ShowStatus struct {
+	authColor   led.Color
+	unauthColor led.Color
+	faultColor  led.Color
+	fadeDelay   time.Duration
+}
+
+type showStatusParams struct {
+	// Hex RGB, used when the media config of the band doesn't have a color
+	AuthorizedColor   string `yaml:"authorized-color"`
+	UnauthorizedColor string `yaml:"unauthorized-color"`
+	// Used when the band couldn't be checked (e.g. rfid-security-svc is unreachable)
+	FaultColor string `yaml:"fault-color"`
+	// The delay between each step of the fade
+	FadeDelay *time.Duration `yaml:"fade-delay"`
+}
+
+func NewShowStatus(step config.Step) (context.Handler, error) {
+	var params showStatusParams
+	if err := step.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	authColor, err := colorParam(step, params.AuthorizedColor, defaultAuthColor)
+	if err != nil {
+		return nil, err
+	}
+	unauthColor, err := colorParam(step, params.UnauthorizedColor, defaultUnauthColor)
+	if err != nil {
+		return nil, err
+	}
+	faultColor, err := colorParam(step, params.FaultColor, defaultFaultColor)
+	if err != nil {
+		return nil, err
+	}
+	h := &ShowStatus{authColor: authColor, unauthColor: unauthColor, faultColor: faultColor, fadeDelay: fadeEffectDelay}
+	if params.FadeDelay != nil {
+		if *params.FadeDelay < 0 {
+			return nil, step.Errorf("fade-delay: '%v', must not be negative", *params.FadeDelay)
+		}
+		h.fadeDelay = *params.FadeDelay
+	}
+	return h, nil
+}
 
-func (h *ShowStatus) Handle(e event.Event) error {
+func (h *ShowStatus) Handle(pc *context.PipelineContext, e event.Event) error {
 	log.Trace("Showing status")
 	switch e.Type() {
 	case event.AUTHORIZED:
-		return runAsync("showStatus", func() {
-			if err := context.LEDController.FadeOn(resolveColor(), fadeEffectDelay); err != nil {
+		color := h.resolveColor(pc.MediaConfig())
+		pc.RunAsync(showingStatus, func(stop <-chan bool) {
+			if err := context.LEDController.FadeOn(color, h.fadeDelay); err != nil {
 				log.Errorf("showStatus: failed to fade on: %v", err)
 			}
 		})
 	case event.UNAUTHORIZED:
-		return runAsync("showStatus", func() {
-			if err := context.LEDController.FadeOn(led.BLUE, fadeEffectDelay); err != nil {
+		color := h.unauthColor
+		if e.Reason().IsFault() {
+			color = h.faultColor
+		}
+		pc.RunAsync(showingStatus, func(stop <-chan bool) {
+			if err := context.LEDController.FadeOn(color, h.fadeDelay); err != nil {
 				log.Errorf("showStatus: failed to fade on: %v", err)
 			}
 		})
@@ -34,23 +86,20 @@ func (h *ShowStatus) Handle(e event.Event) error {
 	return nil
 }
 
-func resolveColor() led.Color {
-	// Not sure how this would happen but we don't have a MediaConfig object in state
-	if context.State["mediaConfig"] == nil {
-		log.Warnf("Unable to find mediaConfig in State, using default authorized color")
-		return defaultAuthColor
+func (h *ShowStatus) resolveColor(mediaConfig *rfidsecuritysvc.MediaConfig) led.Color {
+	// The pipeline doesn't authorize the band before this step
+	if mediaConfig == nil {
+		log.Warnf("No mediaConfig for the event, using default authorized color")
+		return h.authColor
 	}
 
-	mediaConfig := context.State["mediaConfig"].(*rfidsecuritysvc.MediaConfig)
 	if mediaConfig.Color == nil {
 		log.Debugf("No color configured in mediaConfig, using default authorized color")
-		return defaultAuthColor
+		return h.authColor
 	}
 	return led.Color(uint32(mediaConfig.Color.Int))
 }
 
 func init() {
-	if err := context.RegisterHandler(20, &ShowStatus{}); err != nil {
-		panic(err)
-	}
+	register("show-status", NewShowStatus, context.ABORT)
 }
@@ -3,6 +3,7 @@ package handler
 import (
 	log "github.com/sirupsen/logrus"
 
+	"github.com/bcurnow/magicband-reader/config"
 	"github.com/bcurnow/magicband-reader/context"
 	"github.com/bcurnow/magicband-reader/event"
 	"github.com/bcurnow/magicband-reader/led"
@@ -13,22 +14,53 @@ const (
 	reverseSpin     = true
 )
 
-type Spin struct{}
+type Spin struct {
+	color   led.Color
+	width   int
+	reverse bool
+}
 
-func (h *Spin) Handle(e event.Event) error {
-	log.Trace("Spinning the lights")
-	stop := make(chan bool)
-	context.State["stopSpinning"] = stop
+type spinParams struct {
+	// Hex RGB, defaults to white
+	Color string `yaml:"color"`
+	// The number of LEDs lit at once
+	Width *int `yaml:"width"`
+	// Spin counter clockwise
+	Reverse *bool `yaml:"reverse"`
+}
+
+func NewSpin(step config.Step) (context.Handler, error) {
+	var params spinParams
+	if err := step.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	color, err := colorParam(step, params.Color, led.WHITE)
+	if err != nil {
+		return nil, err
+	}
+	h := &Spin{color: color, width: colorChaseWidth, reverse: reverseSpin}
+	if params.Width != nil {
+		if *params.Width < 1 {
+			return nil, step.Errorf("width: '%v', must be at least 1", *params.Width)
+		}
+		h.width = *params.Width
+	}
+	if params.Reverse != nil {
+		h.reverse = *params.Reverse
+	}
+	return h, nil
+}
 
-	return runAsync("spinning", func() {
-		if err := context.LEDController.Spin(led.WHITE, reverseSpin, colorChaseWidth, stop); err != nil {
+func (h *Spin) Handle(pc *context.PipelineContext, e event.Event) error {
+	log.Trace("Spinning the lights")
+	pc.RunAsync(spinning, func(stop <-chan bool) {
+		if err := context.LEDController.Spin(h.color, h.reverse, h.width, stop); err != nil {
 			log.Errorf("spin: failed to spin: %v", err)
 		}
 	})
+	return nil
 }
 
 func init() {
-	if err := context.RegisterHandler(11, &Spin{}); err != nil {
-		panic(err)
-	}
+	register("spin", NewSpin, context.ABORT)
 }
@@ -3,28 +3,34 @@ package handler
 import (
 	log "github.com/sirupsen/logrus"
 
+	"github.com/bcurnow/magicband-reader/config"
 	"github.com/bcurnow/magicband-reader/context"
 	"github.com/bcurnow/magicband-reader/event"
 )
 
 type StopSpin struct{}
 
-func (h *StopSpin) Handle(e event.Event) error {
-	log.Trace("Stopping the spin")
-	waitForAsync("readSoundPlaying")
+func NewStopSpin(step config.Step) (context.Handler, error) {
+	if err := noParams(step); err != nil {
+		return nil, err
+	}
+	return &StopSpin{}, nil
+}
 
-	// Make the spinning stop
-	close(context.State["stopSpinning"].(chan bool))
-	defer context.ClearState("stopSpinning")
+func (h *StopSpin) Handle(pc *context.PipelineContext, e event.Event) error {
+	log.Trace("Stopping the spin")
+	if err := pc.WaitForAsync(readSoundPlaying); err != nil {
+		return err
+	}
 
-	// Wait for the actual spinning to stop
-	waitForAsync("spinning")
+	// Make the spinning stop and wait for it to actually stop
+	if err := pc.StopAsync(spinning); err != nil {
+		return err
+	}
 	log.Trace("Spinning has stopped")
 	return nil
 }
 
 func init() {
-	if err := context.RegisterHandler(13, &StopSpin{}); err != nil {
-		panic(err)
-	}
+	register("stop-spin", NewStopSpin, context.CLEANUP)
 }
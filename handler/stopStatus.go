@@ -1,20 +1,49 @@
 package handler
 
 import (
+	"time"
+
 	log "github.com/sirupsen/logrus"
 
+	"github.com/bcurnow/magicband-reader/config"
 	"github.com/bcurnow/magicband-reader/context"
 	"github.com/bcurnow/magicband-reader/event"
 )
 
-type StopStatus struct{}
+type StopStatus struct {
+	fadeDelay time.Duration
+}
+
+type stopStatusParams struct {
+	// The delay between each step of the fade
+	FadeDelay *time.Duration `yaml:"fade-delay"`
+}
 
-func (h *StopStatus) Handle(e event.Event) error {
+func NewStopStatus(step config.Step) (context.Handler, error) {
+	var params stopStatusParams
+	if err := step.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	h := &StopStatus{fadeDelay: fadeEffectDelay}
+	if params.FadeDelay != nil {
+		if *params.FadeDelay < 0 {
+			return nil, step.Errorf("fade-delay: '%v', must not be negative", *params.FadeDelay)
+		}
+		h.fadeDelay = *params.FadeDelay
+	}
+	return h, nil
+}
+
+func (h *StopStatus) Handle(pc *context.PipelineContext, e event.Event) error {
 	log.Trace("Waiting for the auth sound to stop")
-	waitForAsync("authSoundPlaying")
-	waitForAsync("showStatus")
+	if err := pc.WaitForAsync(authSoundPlaying); err != nil {
+		return err
+	}
+	if err := pc.WaitForAsync(showingStatus); err != nil {
+		return err
+	}
 
-	if err := context.LEDController.FadeOff(fadeEffectDelay); err != nil {
+	if err := context.LEDController.FadeOff(h.fadeDelay); err != nil {
 		return err
 	}
 	log.Trace("auth sound has stopped")
@@ -22,7 +51,5 @@ func (h *StopStatus) Handle(e event.Event) error {
 }
 
 func init() {
-	if err := context.RegisterHandler(22, &StopStatus{}); err != nil {
-		panic(err)
-	}
+	register("stop-status", NewStopStatus, context.CLEANUP)
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	readerctx "github.com/bcurnow/magicband-reader/context"
+	"github.com/bcurnow/magicband-reader/reader"
+	"github.com/bcurnow/magicband-reader/rfidsecuritysvc"
+)
+
+const (
+	statusOK       = "ok"
+	statusReady    = "ready"
+	statusNotReady = "not ready"
+)
+
+// componentStatus is the readiness of a single component in the /readyz response
+type componentStatus struct {
+	Ready  bool   `json:"ready"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// readinessCheck reports whether a component is ready to handle reads
+type readinessCheck func() componentStatus
+
+type healthResult struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components,omitempty"`
+}
+
+// AddReadinessCheck adds a component to /readyz, the router is only ready when every component is
+func (r *router) AddReadinessCheck(component string, check readinessCheck) {
+	r.readinessLock.Lock()
+	defer r.readinessLock.Unlock()
+	r.readiness[component] = check
+}
+
+// addDefaultReadinessChecks adds the components the context owns, the readers are added by main once
+// they've been created
+func (r *router) addDefaultReadinessChecks() {
+	r.AddReadinessCheck("led", func() componentStatus {
+		if readerctx.LEDController == nil {
+			return componentStatus{Detail: "not initialized"}
+		}
+		return componentStatus{Ready: true}
+	})
+	r.AddReadinessCheck("sound-cache", func() componentStatus {
+		if readerctx.AudioCache == nil || !readerctx.AudioCache.Synced() {
+			return componentStatus{Detail: "not synced"}
+		}
+		return componentStatus{Ready: true}
+	})
+	r.AddReadinessCheck("rfid-security-svc", func() componentStatus {
+		if readerctx.RFIDSecuritySvc == nil {
+			return componentStatus{Detail: "not initialized"}
+		}
+		if breaker := readerctx.RFIDSecuritySvc.Breaker(); breaker.State == rfidsecuritysvc.OPEN {
+			return componentStatus{Detail: fmt.Sprintf("circuit breaker open since %v", breaker.OpenedAt.Format(time.RFC3339))}
+		}
+		// No calls yet counts as ready, the sound cache sync is the first call
+		if lastCall := readerctx.RFIDSecuritySvc.LastCall(); lastCall.Error != nil {
+			return componentStatus{Detail: lastCall.Error.Error()}
+		}
+		return componentStatus{Ready: true}
+	})
+}
+
+// readerReadiness reports a reader as ready as long as its watchdog considers it healthy
+func readerReadiness(watchdog *reader.Watchdog) readinessCheck {
+	return func() componentStatus {
+		health := watchdog.Health()
+		if health.State != reader.HEALTHY {
+			return componentStatus{Detail: health.State.String() + ": " + health.LastError}
+		}
+		return componentStatus{Ready: true}
+	}
+}
+
+// handleHealthRequest reports the process is alive, it doesn't check any of the components
+func handleHealthRequest(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, healthResult{Status: statusOK})
+}
+
+// handleReadyRequest reports whether every component is ready, with a 503 if any of them isn't
+func handleReadyRequest(r *router, w http.ResponseWriter, req *http.Request) {
+	r.readinessLock.RLock()
+	defer r.readinessLock.RUnlock()
+	result := healthResult{Status: statusReady, Components: make(map[string]componentStatus)}
+	for component, check := range r.readiness {
+		status := check()
+		if !status.Ready {
+			result.Status = statusNotReady
+		}
+		result.Components[component] = status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != statusReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, result)
+}
@@ -1,5 +1,11 @@
 package led
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type Color uint32
 
 const (
@@ -142,3 +148,13 @@ const (
 	YELLOW                  Color = 0xFFFF00
 	YELLOW_GREEN            Color = 0x9ACD32
 )
+
+// ParseColor parses a hex RGB color, with or without a leading '#' or '0x' (e.g. "#00FF00")
+func ParseColor(color string) (Color, error) {
+	hex := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(color), "#"), "0x")
+	value, err := strconv.ParseUint(hex, 16, 24)
+	if err != nil {
+		return 0, fmt.Errorf("'%v' is not a hex RGB color (e.g. #00FF00)", color)
+	}
+	return Color(value), nil
+}
@@ -6,6 +6,8 @@ import (
 
 	ws2811 "github.com/rpi-ws281x/rpi-ws281x-go"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/bcurnow/magicband-reader/metrics"
 )
 
 const (
@@ -107,7 +109,7 @@ func (c *controller) Blink(color Color, iterations int, delay time.Duration) err
 func (c *controller) LightsOn(color Color) error {
 	c.setBrightness(c.brightness)
 	c.fill(color)
-	if err := c.strip.Render(); err != nil {
+	if err := c.render(); err != nil {
 		return err
 	}
 	return nil
@@ -118,7 +120,7 @@ func (c *controller) FadeOn(color Color, delay time.Duration) error {
 
 	for currentBrightness := 1; currentBrightness <= c.brightness; currentBrightness++ {
 		c.setBrightness(currentBrightness)
-		if err := c.strip.Render(); err != nil {
+		if err := c.render(); err != nil {
 			return err
 		}
 		time.Sleep(delay)
@@ -128,7 +130,7 @@ func (c *controller) FadeOn(color Color, delay time.Duration) error {
 
 func (c *controller) LightsOff() error {
 	c.fill(0)
-	if err := c.strip.Render(); err != nil {
+	if err := c.render(); err != nil {
 		return err
 	}
 	return nil
@@ -137,7 +139,7 @@ func (c *controller) LightsOff() error {
 func (c *controller) FadeOff(delay time.Duration) error {
 	for currentBrightness := c.currentBrightness; currentBrightness >= 0; currentBrightness-- {
 		c.setBrightness(currentBrightness)
-		if err := c.strip.Render(); err != nil {
+		if err := c.render(); err != nil {
 			return err
 		}
 		time.Sleep(delay)
@@ -168,7 +170,7 @@ func (c *controller) ColorChase(color Color, delay time.Duration, reverse bool,
 			c.setLedColor(off, 0)
 		}
 
-		if err := c.strip.Render(); err != nil {
+		if err := c.render(); err != nil {
 			return err
 		}
 		if i < c.outerRingSize+effectLength {
@@ -222,6 +224,15 @@ func (c *controller) handleDefaults() {
 	}
 }
 
+// render updates the strip, failures are counted in the metrics
+func (c *controller) render() error {
+	if err := c.strip.Render(); err != nil {
+		metrics.LEDErrors.Inc()
+		return err
+	}
+	return nil
+}
+
 func (c *controller) setLedColor(led int, color Color) {
 	c.strip.Leds(0)[led] = uint32(color)
 }
@@ -1,110 +1,166 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/bcurnow/magicband-reader/config"
-	"github.com/bcurnow/magicband-reader/context"
+	readerctx "github.com/bcurnow/magicband-reader/context"
 	"github.com/bcurnow/magicband-reader/event"
+	"github.com/bcurnow/magicband-reader/handler"
 	"github.com/bcurnow/magicband-reader/led"
+	"github.com/bcurnow/magicband-reader/metrics"
+	"github.com/bcurnow/magicband-reader/reader"
 )
 
 const (
 	blinkIterations = 2
 	blinkDelay      = 500 * time.Millisecond
+	// How long to wait before reading again after an unexpected error
+	readErrorDelay = 1 * time.Second
 )
 
 func main() {
-	router, err := NewRouter(config.ListenAddress, config.ListenPort)
-	if err != nil {
-		panic(err)
+	if err := handler.Configure(config.Pipeline, config.HandlerTimeout); err != nil {
+		log.Fatalf("Unable to configure the pipeline: %v", err)
 	}
 
-	shutdown := make(chan bool)
-
-	reader, err := NewDefaultReader()
+	readerIDs := make([]string, 0, len(config.Readers))
+	for _, readerConfig := range config.Readers {
+		readerIDs = append(readerIDs, readerConfig.ID)
+	}
+	router, err := NewRouter(RouterConfig{
+		ListenAddress:           config.ListenAddress,
+		ListenPort:              config.ListenPort,
+		APIKey:                  config.ListenAPIKey,
+		TLSCertFile:             config.ListenTLSCert,
+		TLSKeyFile:              config.ListenTLSKey,
+		TLSClientCAFile:         config.ListenTLSClientCA,
+		WaitersSuppressHandlers: config.WebWaitersSuppressHandlers,
+		AdminAPI:                config.ListenAdminAPI,
+		ReaderIDs:               readerIDs,
+	})
 	if err != nil {
 		panic(err)
 	}
 
-	// Make sure to clean up everything when we exit
-	go func() {
-		osSignals := make(chan os.Signal, 1)
-		signal.Notify(osSignals, os.Interrupt, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT)
-		sig := <-osSignals
-		log.Tracef("Received %v", sig)
-		close(osSignals)
-		router.Close()
-		reader.Close()
-		if err := context.Close(); err != nil {
-			log.Errorf("Error closing context: %v", err)
+	// Everything is shutdown by cancelling this context when we receive an OS signal
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	readers := make([]*reader.Watchdog, 0, len(config.Readers))
+	trackers := make(map[string]*reader.PresenceTracker)
+	for _, readerConfig := range config.Readers {
+		rfidReader, err := reader.New(reader.Config{
+			Type:            readerConfig.Type,
+			SimulatedSource: readerConfig.SimulatedSource,
+			SPIBus:          readerConfig.SPIBus,
+			SPIDevice:       readerConfig.SPIDevice,
+			SPISpeed:        readerConfig.SPISpeed,
+			ResetPin:        readerConfig.ResetPin,
+			IRQPin:          readerConfig.IRQPin,
+			AntennaGain:     readerConfig.AntennaGain,
+			ReadTagData:     readerConfig.ReadTagData,
+			PN532Interface:  readerConfig.PN532Interface,
+			I2CBus:          readerConfig.I2CBus,
+			I2CAddress:      readerConfig.I2CAddress,
+			UARTPort:        readerConfig.UARTPort,
+			UARTBaud:        readerConfig.UARTBaud,
+			EvdevDevice:     readerConfig.EvdevDevice,
+			EvdevGrab:       readerConfig.EvdevGrab,
+			EvdevUIDFormat:  readerConfig.EvdevUIDFormat,
+		})
+		if err != nil {
+			log.Fatalf("Unable to initialize reader '%v': %v", readerConfig.ID, err)
+		}
+
+		watchdog, err := reader.NewWatchdog(readerConfig.ID, rfidReader, config.ReaderWatchdogInterval, config.ReaderWatchdogMaxErrors, config.ReaderWatchdogMaxIdle)
+		if err != nil {
+			rfidReader.Close()
+			log.Fatalf("Unable to initialize reader '%v': %v", readerConfig.ID, err)
 		}
-		close(shutdown)
-	}()
+		readers = append(readers, watchdog)
+		router.AddReadinessCheck("reader:"+readerConfig.ID, readerReadiness(watchdog))
+		metrics.RegisterReader(readerConfig.ID, func() map[string]uint64 {
+			stats := watchdog.Stats()
+			return map[string]uint64{"retry": stats.Retries, "irq": stats.IRQErrors, "no_card": stats.NoCardErrors}
+		})
+
+		tracker, err := reader.NewPresenceTracker(watchdog, config.ReaderPollTimeout, config.ReaderRemovalPolls)
+		if err != nil {
+			log.Fatalf("Unable to initialize reader '%v': %v", readerConfig.ID, err)
+		}
+		trackers[readerConfig.ID] = tracker
+	}
 
 	//Blink the LED strip to indicate that the software is started and we're reading
 	//the UID
-	if err := context.LEDController.Blink(led.WHITE, blinkIterations, blinkDelay); err != nil {
+	if err := readerctx.LEDController.Blink(led.WHITE, blinkIterations, blinkDelay); err != nil {
 		log.Errorf("Error blinking startup indicator: %v", err)
 	}
 	log.Info("Waiting for MagicBand...")
 
-	// There's an issue with the library we're using that I didn't see in the Python version
-	// As long as you hold the band over the reader, it just keeps reporting the UID over and over
-	// To fix this, we're going to throw away any uid reads which are the same as the last UID and
-	// happened within 10 seconds
-	var lastUid string
-	stopUidCleanup := make(chan bool)
-	uidCleanupInit := 24 * time.Hour
-	uidCleanupPeriod := 10 * time.Second
-	uidCleanup := time.NewTicker(uidCleanupInit)
-	go func() {
-		for {
-			select {
-			case <-stopUidCleanup:
-				return
-			case <-uidCleanup.C:
-				log.Tracef("Clearing '%v' from lastUid", lastUid)
-				// Time to clean out the UID
-				lastUid = ""
-				uidCleanup.Reset(uidCleanupInit)
-			}
-		}
-	}()
+	var wg sync.WaitGroup
+	for readerID, tracker := range trackers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readLoop(ctx, router, readerID, tracker)
+		}()
+	}
+	wg.Wait()
+	stop()
 
-	for !router.Closed() {
-		// Set a really long wait time
-		uid, err := reader.UID(24 * time.Hour)
+	// Make sure to clean up everything now that the readers have stopped
+	log.Debug("Shutting down")
+	router.Close()
+	for _, rfidReader := range readers {
+		rfidReader.Close()
+	}
+	if err := readerctx.Close(); err != nil {
+		log.Errorf("Error closing context: %v", err)
+	}
+	log.Info("Shutdown complete")
+}
+
+// readLoop routes every band presented to a single reader until ctx is cancelled
+func readLoop(ctx context.Context, router Router, readerID string, tracker *reader.PresenceTracker) {
+	// As long as a band is held over the reader it keeps reporting the UID over and over, the tracker
+	// only reports the band once when it's presented and again once it's been removed
+	for {
+		presence, err := tracker.Next(ctx)
 		if err != nil {
-			if _, ok := err.(TimeoutError); ok {
-				continue
+			if ctx.Err() != nil || errors.Is(err, reader.ErrHalted) {
+				// We're shutting down due to an OS signal
+				break
+			}
+			// Don't know what happened, the watchdog takes care of recovering the hardware so back off and
+			// keep reading
+			log.Errorf("Error reading from reader '%v', retrying in %v: %v", readerID, readErrorDelay, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(readErrorDelay):
 			}
-			// Don't know what happened
-			panic(err)
+			continue
 		}
 
-		// uid will be "" if the reader was shutdown due to an OS signal
-		// we only want to route the uid once so only route if it's a different uid
-		if uid != "" && uid != lastUid {
-			if err := router.Route(event.NewEvent(uid, event.UNKNOWN)); err != nil {
+		switch presence.Type {
+		case reader.PRESENTED:
+			e := event.NewEvent(readerID, presence.UID, event.UNKNOWN)
+			e.SetTag(presence.Tag)
+			if err := router.Route(ctx, e); err != nil {
 				log.Errorf("Error routing event: %v", err)
 			}
-			lastUid = uid
-			uidCleanup.Reset(uidCleanupPeriod)
+		case reader.REMOVED:
+			log.Debugf("%v was removed from reader '%v'", presence.UID, readerID)
 		}
 	}
-
-	// Stop the UID cleaner
-	log.Trace("Stopping the UID cleaner")
-	uidCleanup.Stop()
-	close(stopUidCleanup)
-
-	log.Debug("Waiting for shutdown")
-	<-shutdown
-	log.Info("Shutdown complete")
+	log.Tracef("Reader '%v' stopped", readerID)
 }
@@ -0,0 +1,137 @@
+/*
+ * The metrics package holds the Prometheus metrics exported on /metrics, the packages which own the
+ * behavior being measured update them directly.
+ */
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "magicband_reader"
+)
+
+var (
+	Reads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reads_total",
+		Help:      "The number of bands presented to each reader.",
+	}, []string{"reader"})
+	Events = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_total",
+		Help:      "The number of routed reads by final event type (AUTHORIZED, UNAUTHORIZED or UNKNOWN) and why it's UNAUTHORIZED (DENIED, UNKNOWN_MEDIA, SERVICE_ERROR or TIMEOUT).",
+	}, []string{"reader", "type", "reason"})
+	UpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "The latency of rfid-security-svc requests by endpoint and status code ('error' if there was no response).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "code"})
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "The number of failed rfid-security-svc requests (no response or an unexpected status code) by endpoint.",
+	}, []string{"endpoint"})
+	UpstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "The number of rfid-security-svc requests which were retried by endpoint.",
+	}, []string{"endpoint"})
+	UpstreamBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_breaker_state",
+		Help:      "The state of the rfid-security-svc circuit breaker: 0 = closed, 1 = half open, 2 = open.",
+	})
+	AuditEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_events_total",
+		Help:      "The number of audit events by result: queued (every event goes through the outbox), then delivered, rejected (by rfid-security-svc) or dropped.",
+	}, []string{"result"})
+	AuditOutboxSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "audit_outbox_size",
+		Help:      "The number of audit events waiting in the outbox to be delivered.",
+	})
+	HandlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "How long each handler takes by priority and handler.",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"priority", "handler"})
+	HandlerFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handler_failures_total",
+		Help:      "The number of times each handler failed by reason (error, panic or timeout).",
+	}, []string{"handler", "reason"})
+	AudioErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audio_errors_total",
+		Help:      "The number of sounds which failed to load.",
+	})
+	LEDErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "led_errors_total",
+		Help:      "The number of failed LED strip updates.",
+	})
+	WebWaiters = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "web_waiters",
+		Help:      "The number of /get_uid requests waiting for a read.",
+	})
+	StreamSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stream_subscribers",
+		Help:      "The number of /events subscribers.",
+	})
+
+	readerErrors = &readerErrorsCollector{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "reader_errors_total"),
+			"The number of reader errors by reader and type.", []string{"reader", "type"}, nil),
+		readers: make(map[string]func() map[string]uint64),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(readerErrors)
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterReader adds the error counts of a reader to reader_errors_total, errors is called on every
+// scrape and returns the counts by type
+func RegisterReader(readerID string, errors func() map[string]uint64) {
+	readerErrors.Lock()
+	defer readerErrors.Unlock()
+	readerErrors.readers[readerID] = errors
+}
+
+// readerErrorsCollector reports the counts the readers already keep rather than duplicating them
+type readerErrorsCollector struct {
+	desc    *prometheus.Desc
+	readers map[string]func() map[string]uint64
+	sync.Mutex
+}
+
+func (c *readerErrorsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *readerErrorsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+	for readerID, errors := range c.readers {
+		for errorType, count := range errors() {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(count), readerID, errorType)
+		}
+	}
+}
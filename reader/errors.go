@@ -0,0 +1,50 @@
+package reader
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var (
+	// The reader was halted (e.g. by Close), no more UIDs will be read
+	ErrHalted = errors.New("reader halted")
+	// The reader raised an IRQ error or sent a corrupt response, the device is re-initialized before reading again
+	ErrIRQ = errors.New("reader IRQ error")
+	// Something was detected in the field but it wasn't a card that could be read
+	ErrNoCard = errors.New("no card in the field")
+	// No card was read before the timeout
+	ErrTimeout = errors.New("Timeout waiting for device data")
+)
+
+// Stats are the running totals of what happened while reading
+type Stats struct {
+	// UIDs successfully read
+	Reads uint64
+	// Reads which failed with an unexpected error and were tried again
+	Retries uint64
+	// Reads which failed with ErrIRQ
+	IRQErrors uint64
+	// Reads which failed with ErrNoCard
+	NoCardErrors uint64
+	// Times the device was re-initialized
+	Reinits uint64
+}
+
+// readStats is embedded by the backends to keep their Stats, it's safe to update from the read goroutines
+type readStats struct {
+	reads        atomic.Uint64
+	retries      atomic.Uint64
+	irqErrors    atomic.Uint64
+	noCardErrors atomic.Uint64
+	reinits      atomic.Uint64
+}
+
+func (s *readStats) Stats() Stats {
+	return Stats{
+		Reads:        s.reads.Load(),
+		Retries:      s.retries.Load(),
+		IRQErrors:    s.irqErrors.Load(),
+		NoCardErrors: s.noCardErrors.Load(),
+		Reinits:      s.reinits.Load(),
+	}
+}
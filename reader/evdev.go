@@ -0,0 +1,210 @@
+package reader
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// The UID is typed as a decimal number, most significant byte first
+	EvdevDecimal = "decimal"
+	// The UID is typed as a decimal number, least significant byte first
+	EvdevDecimalReversed = "decimal-reversed"
+	// The UID is typed as hex
+	EvdevHex = "hex"
+
+	evKey        = 0x01
+	keyPressed   = 1
+	keyEnter     = 28
+	keyKPEnter   = 96
+	evdevIOCGrab = 0x40044590
+)
+
+var (
+	// Maps the Linux key codes to the character they type, only the keys which can make up a UID are needed
+	evdevKeys = map[uint16]byte{
+		2: '1', 3: '2', 4: '3', 5: '4', 6: '5', 7: '6', 8: '7', 9: '8', 10: '9', 11: '0',
+		30: 'A', 48: 'B', 46: 'C', 32: 'D', 18: 'E', 33: 'F',
+		79: '1', 80: '2', 81: '3', 75: '4', 76: '5', 77: '6', 71: '7', 72: '8', 73: '9', 82: '0',
+	}
+)
+
+// inputEvent mirrors struct input_event from linux/input.h, the size of the timestamp depends on the platform
+type inputEvent struct {
+	Time  unix.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// evdevReader reads UIDs from a USB RFID reader which acts as a keyboard (a keyboard wedge), the reader
+// types the UID followed by Enter.
+type evdevReader struct {
+	*uidStream
+	device    string
+	uidFormat string
+	source    io.ReadCloser
+}
+
+// NewEvdev creates a Reader which reads key presses from device (e.g. /dev/input/event0), if grab is true
+// the device is grabbed so the key presses don't also end up on the console or other programs.
+func NewEvdev(device string, grab bool, uidFormat string) (Reader, error) {
+	log.Tracef("Creating new evdev reader with device='%v', grab=%v, uidFormat='%v'", device, grab, uidFormat)
+	if err := validateEvdevFormat(uidFormat); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for reader-evdev-device: '%v': %v", device, err)
+	}
+
+	if grab {
+		if err := grabEvdev(f); err != nil {
+			if err := f.Close(); err != nil {
+				log.Warnf("NewEvdev: failed to close '%v': %v", device, err)
+			}
+			return nil, fmt.Errorf("unable to grab '%v': %v", device, err)
+		}
+	}
+
+	return newEvdevReader(device, f, uidFormat), nil
+}
+
+// newEvdevReader creates a Reader from a stream of input events, this doesn't have to be a real device,
+// a recorded event stream works just as well
+func newEvdevReader(device string, source io.ReadCloser, uidFormat string) *evdevReader {
+	r := &evdevReader{
+		uidStream: newUIDStream(),
+		device:    device,
+		uidFormat: uidFormat,
+		source:    source,
+	}
+	go r.run()
+	return r
+}
+
+func validateEvdevFormat(uidFormat string) error {
+	switch uidFormat {
+	case EvdevDecimal, EvdevDecimalReversed, EvdevHex:
+		return nil
+	}
+	return fmt.Errorf("invalid value for reader-evdev-uid-format: '%v', must be one of: %v, %v, %v", uidFormat, EvdevDecimal, EvdevDecimalReversed, EvdevHex)
+}
+
+func grabEvdev(f *os.File) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var grabErr error
+	if err := conn.Control(func(fd uintptr) {
+		grabErr = unix.IoctlSetInt(int(fd), evdevIOCGrab, 1)
+	}); err != nil {
+		return err
+	}
+	return grabErr
+}
+
+func (r *evdevReader) run() {
+	var typed strings.Builder
+	buffer := make([]byte, unsafe.Sizeof(inputEvent{}))
+	for {
+		if _, err := io.ReadFull(r.source, buffer); err != nil {
+			// The source is closed underneath us by Close
+			if !r.isShutdown() {
+				log.Errorf("evdevReader: error reading from '%v': %v", r.device, err)
+			}
+			return
+		}
+
+		var event inputEvent
+		if _, err := binary.Decode(buffer, binary.NativeEndian, &event); err != nil {
+			log.Errorf("evdevReader: unable to decode event from '%v': %v", r.device, err)
+			return
+		}
+
+		if event.Type != evKey || event.Value != keyPressed {
+			continue
+		}
+
+		if event.Code != keyEnter && event.Code != keyKPEnter {
+			if c, exists := evdevKeys[event.Code]; exists {
+				typed.WriteByte(c)
+			} else {
+				log.Debugf("evdevReader: ignoring key code %v from '%v'", event.Code, r.device)
+			}
+			continue
+		}
+
+		text := typed.String()
+		typed.Reset()
+		if text == "" {
+			continue
+		}
+
+		uid, err := parseEvdevUID(text, r.uidFormat)
+		if err != nil {
+			log.Warnf("evdevReader: ignoring '%v': %v", text, err)
+			continue
+		}
+
+		log.Tracef("Read UID %v", uid)
+		if !r.send(uid) {
+			return
+		}
+	}
+}
+
+// parseEvdevUID converts what the reader typed into the same UID format the MFRC522 produces
+func parseEvdevUID(text string, uidFormat string) (string, error) {
+	if uidFormat == EvdevHex {
+		uid, err := hex.DecodeString(text)
+		if err != nil {
+			return "", fmt.Errorf("uid is not valid hex: %v", err)
+		}
+		return normalizeUID(uid), nil
+	}
+
+	value, ok := new(big.Int).SetString(text, 10)
+	if !ok {
+		return "", fmt.Errorf("uid is not a valid decimal number")
+	}
+
+	// Readers drop the leading zero bytes, UIDs are 4, 7 or 10 bytes long so pad back out to the
+	// shortest one that fits
+	uid := value.Bytes()
+	for _, size := range []int{4, 7, 10} {
+		if len(uid) <= size {
+			uid = append(make([]byte, size-len(uid)), uid...)
+			break
+		}
+	}
+
+	if uidFormat == EvdevDecimalReversed {
+		for i, j := 0, len(uid)-1; i < j; i, j = i+1, j-1 {
+			uid[i], uid[j] = uid[j], uid[i]
+		}
+	}
+	return normalizeUID(uid), nil
+}
+
+func (r *evdevReader) Close() {
+	log.Trace("Closing evdev reader")
+	r.shutdown(func() {
+		if err := r.source.Close(); err != nil {
+			log.Warnf("Close: failed to close '%v': %v", r.device, err)
+		}
+	})
+	log.Trace("Evdev reader closed")
+}
@@ -0,0 +1,191 @@
+package reader
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	evSyn       = 0x00
+	keyReleased = 0
+	keyQ        = 16
+)
+
+// Reverse of evdevKeys using the main keyboard row, the keypad codes are tested separately
+var evdevTestKeys = map[byte]uint16{
+	'1': 2, '2': 3, '3': 4, '4': 5, '5': 6, '6': 7, '7': 8, '8': 9, '9': 10, '0': 11,
+	'A': 30, 'B': 48, 'C': 46, 'D': 32, 'E': 18, 'F': 33,
+}
+
+// recording builds the input_event bytes a keyboard wedge produces
+type recording struct {
+	bytes.Buffer
+}
+
+func (r *recording) event(t *testing.T, eventType uint16, code uint16, value int32) {
+	t.Helper()
+	if err := binary.Write(r, binary.NativeEndian, inputEvent{Type: eventType, Code: code, Value: value}); err != nil {
+		t.Fatalf("unable to record event: %v", err)
+	}
+}
+
+// key records a press and release of code followed by a SYN_REPORT, the same as a real keyboard
+func (r *recording) key(t *testing.T, code uint16) {
+	t.Helper()
+	r.event(t, evKey, code, keyPressed)
+	r.event(t, evSyn, 0, 0)
+	r.event(t, evKey, code, keyReleased)
+	r.event(t, evSyn, 0, 0)
+}
+
+// typed records text being typed on the main keyboard followed by Enter
+func (r *recording) typed(t *testing.T, text string) {
+	t.Helper()
+	for i := 0; i < len(text); i++ {
+		code, exists := evdevTestKeys[text[i]]
+		if !exists {
+			t.Fatalf("no key code for '%c'", text[i])
+		}
+		r.key(t, code)
+	}
+	r.key(t, keyEnter)
+}
+
+// readAll returns the UIDs read from the recording, the recording has been read once UID times out
+func readAll(t *testing.T, r *evdevReader) []string {
+	t.Helper()
+	var uids []string
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		uid, err := r.UID(ctx)
+		cancel()
+		if errors.Is(err, ErrTimeout) {
+			return uids
+		}
+		if err != nil {
+			t.Fatalf("UID: unexpected error: %v", err)
+		}
+		uids = append(uids, uid)
+	}
+}
+
+func TestEvdevReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		uidFormat string
+		record    func(t *testing.T, r *recording)
+		want      []string
+	}{
+		{
+			name:      "decimal",
+			uidFormat: EvdevDecimal,
+			record: func(t *testing.T, r *recording) {
+				// 0x04A1B2C3
+				r.typed(t, "77705923")
+			},
+			want: []string{"04A1B2C3"},
+		},
+		{
+			name:      "decimal padded",
+			uidFormat: EvdevDecimal,
+			record: func(t *testing.T, r *recording) {
+				r.typed(t, "1")
+				// 0x00A1B2C3D4E5F6, too big for 4 bytes so padded to 7
+				r.typed(t, "177789161760246")
+			},
+			want: []string{"00000001", "00A1B2C3D4E5F6"},
+		},
+		{
+			name:      "decimal reversed",
+			uidFormat: EvdevDecimalReversed,
+			record: func(t *testing.T, r *recording) {
+				// 0xC3B2A104
+				r.typed(t, "3283263748")
+			},
+			want: []string{"04A1B2C3"},
+		},
+		{
+			name:      "hex",
+			uidFormat: EvdevHex,
+			record: func(t *testing.T, r *recording) {
+				r.typed(t, "04A1B2C3D4E5F6")
+			},
+			want: []string{"04A1B2C3D4E5F6"},
+		},
+		{
+			name:      "keypad",
+			uidFormat: EvdevDecimal,
+			record: func(t *testing.T, r *recording) {
+				// 1234 on the keypad
+				for _, code := range []uint16{79, 80, 81, 75} {
+					r.key(t, code)
+				}
+				r.key(t, keyKPEnter)
+			},
+			want: []string{"000004D2"},
+		},
+		{
+			name:      "garbage",
+			uidFormat: EvdevHex,
+			record: func(t *testing.T, r *recording) {
+				// Enter on its own
+				r.key(t, keyEnter)
+				// Odd number of hex digits
+				r.typed(t, "ABC")
+				// A key which can't be part of a UID is skipped
+				r.key(t, keyQ)
+				r.typed(t, "04A1B2C3")
+				// Not a key event
+				r.event(t, 0x02, 0, 1)
+				// A truncated event ends the stream
+				r.WriteString("garbage")
+			},
+			want: []string{"04A1B2C3"},
+		},
+		{
+			name:      "garbage decimal",
+			uidFormat: EvdevDecimal,
+			record: func(t *testing.T, r *recording) {
+				// Hex isn't a decimal number
+				r.typed(t, "04A1")
+				r.typed(t, "77705923")
+			},
+			want: []string{"04A1B2C3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var r recording
+			test.record(t, &r)
+
+			reader := newEvdevReader(test.name, io.NopCloser(&r.Buffer), test.uidFormat)
+			defer reader.Close()
+
+			got := readAll(t, reader)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got UIDs %v, want %v", got, test.want)
+			}
+			if reads := reader.Stats().Reads; reads != uint64(len(test.want)) {
+				t.Errorf("got %v reads, want %v", reads, len(test.want))
+			}
+		})
+	}
+}
+
+func TestValidateEvdevFormat(t *testing.T) {
+	for _, uidFormat := range []string{EvdevDecimal, EvdevDecimalReversed, EvdevHex} {
+		if err := validateEvdevFormat(uidFormat); err != nil {
+			t.Errorf("validateEvdevFormat('%v'): unexpected error: %v", uidFormat, err)
+		}
+	}
+	if err := validateEvdevFormat("octal"); err == nil {
+		t.Error("validateEvdevFormat('octal'): expected an error")
+	}
+}
@@ -0,0 +1,366 @@
+package reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/conn/v3/physic"
+	"periph.io/x/conn/v3/spi"
+	"periph.io/x/conn/v3/spi/spireg"
+	"periph.io/x/devices/v3/mfrc522"
+	"periph.io/x/devices/v3/mfrc522/commands"
+	"periph.io/x/host/v3"
+
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+const (
+	// How long the reset pin is held low (and then high) when power cycling the MFRC522
+	mfrc522ResetDelay = 50 * time.Millisecond
+)
+
+type mfrc522Reader struct {
+	readStats
+	spiPort     string
+	speed       physic.Frequency
+	resetPin    gpio.PinIO
+	irqPin      gpio.PinIO
+	antennaGain int
+	readTagData bool
+	portCloser  spi.PortCloser
+	// Swapped when the device is recovered, Close reads it without holding the lock
+	device atomic.Pointer[mfrc522.Dev]
+	closed atomic.Bool
+	sync.Mutex
+}
+
+// NewMFRC522 creates a Reader backed by an MFRC522 attached to SPI, the SPI port, pins and antenna gain
+// all come from config and are validated before the hardware is touched.
+func NewMFRC522(config Config) (Reader, error) {
+	log.Tracef("Creating new MFRC522 reader with spiBus=%v, spiDevice=%v, spiSpeed='%v', resetPin='%v', irqPin='%v', antennaGain=%v",
+		config.SPIBus, config.SPIDevice, config.SPISpeed, config.ResetPin, config.IRQPin, config.AntennaGain)
+	var reader = mfrc522Reader{antennaGain: config.AntennaGain, readTagData: config.ReadTagData}
+
+	if config.SPIBus < 0 {
+		return nil, fmt.Errorf("invalid value for reader-spi-bus: '%v', must be 0 or greater", config.SPIBus)
+	}
+	if config.SPIDevice < 0 {
+		return nil, fmt.Errorf("invalid value for reader-spi-device: '%v', must be 0 or greater", config.SPIDevice)
+	}
+	if config.AntennaGain < 0 || config.AntennaGain > 7 {
+		return nil, fmt.Errorf("invalid value for reader-antenna-gain: '%v', must be between 0 and 7 inclusive", config.AntennaGain)
+	}
+	if err := reader.speed.Set(config.SPISpeed); err != nil {
+		return nil, fmt.Errorf("invalid value for reader-spi-speed: '%v': %v", config.SPISpeed, err)
+	}
+	if reader.speed <= 0 {
+		return nil, fmt.Errorf("invalid value for reader-spi-speed: '%v', must be greater than 0", config.SPISpeed)
+	}
+
+	// Make sure periph is initialized.
+	if _, err := host.Init(); err != nil {
+		return nil, err
+	}
+
+	// Pins can only be resolved once periph is initialized
+	var err error
+	if reader.resetPin, err = resolvePin(config.ResetPin, "reader-reset-pin"); err != nil {
+		return nil, err
+	}
+	if reader.irqPin, err = resolvePin(config.IRQPin, "reader-irq-pin"); err != nil {
+		return nil, err
+	}
+
+	reader.spiPort = fmt.Sprintf("SPI%v.%v", config.SPIBus, config.SPIDevice)
+	if err := reader.open(); err != nil {
+		return nil, err
+	}
+	return &reader, nil
+}
+
+// open opens the SPI port and initializes the device
+func (r *mfrc522Reader) open() error {
+	pc, err := spireg.Open(r.spiPort)
+	if err != nil {
+		return fmt.Errorf("invalid value for reader-spi-bus/reader-spi-device: unable to open '%v': %v", r.spiPort, err)
+	}
+	r.portCloser = pc
+
+	// The driver always connects at its own maximum speed, limiting the port caps that
+	if err := pc.LimitSpeed(r.speed); err != nil {
+		r.closePort()
+		return fmt.Errorf("invalid value for reader-spi-speed: '%v': %v", r.speed, err)
+	}
+
+	device, err := mfrc522.NewSPI(pc, r.resetPin, r.irqPin)
+	if err != nil {
+		r.closePort()
+		return err
+	}
+
+	if err := device.SetAntennaGain(r.antennaGain); err != nil {
+		r.closePort()
+		return err
+	}
+
+	r.device.Store(device)
+	return nil
+}
+
+func resolvePin(name string, flagName string) (gpio.PinIO, error) {
+	pin := gpioreg.ByName(name)
+	if pin == nil {
+		return nil, fmt.Errorf("invalid value for %v: '%v', no pin found with that name", flagName, name)
+	}
+	return pin, nil
+}
+
+func (r *mfrc522Reader) closePort() {
+	if r.portCloser == nil {
+		// Already closed by a failed recovery
+		return
+	}
+	if err := r.portCloser.Close(); err != nil {
+		log.Warnf("closePort: failed to close port: %v", err)
+	}
+	r.portCloser = nil
+}
+
+func (r *mfrc522Reader) Close() {
+	log.Trace("Closing Reader")
+	r.closed.Store(true)
+	// Halt the device before we lock, this will stop any in-progress reads
+	log.Trace("Halting the device")
+	halted := r.device.Load()
+	r.halt(halted)
+	log.Trace("Device halted")
+
+	//Make sure to lock before we close the underlying port or we'll cause a SIGSEGV
+	log.Trace("Acquiring the lock")
+	r.Lock()
+	defer r.Unlock()
+	log.Trace("Lock acquired")
+	if current := r.device.Load(); current != halted {
+		// The device was recovered while we were halting the old one
+		r.halt(current)
+	}
+	//Close the underlying SPI port
+	log.Trace("Closing the portCloser")
+	r.closePort()
+	log.Trace("Reader closed")
+}
+
+func (r *mfrc522Reader) halt(device *mfrc522.Dev) {
+	if device == nil {
+		return
+	}
+	if err := device.Halt(); err != nil {
+		log.Warnf("Close: failed to halt device: %v", err)
+	}
+}
+
+func (r *mfrc522Reader) UID(ctx context.Context) (string, error) {
+	uid, _, err := readUID(ctx, r)
+	return uid, err
+}
+
+func (r *mfrc522Reader) ReadTag(ctx context.Context) (string, *event.Tag, error) {
+	return readUID(ctx, r)
+}
+
+func (r *mfrc522Reader) isClosed() bool {
+	return r.closed.Load()
+}
+
+func (r *mfrc522Reader) readUID(timeout time.Duration) ([]byte, *event.Tag, error) {
+	device := r.device.Load()
+	if device == nil {
+		// A recovery failed, wait for the watchdog to try again
+		time.Sleep(timeout)
+		return nil, nil, fmt.Errorf("%w: the MFRC522 is unavailable until it's recovered", ErrTimeout)
+	}
+	if r.readTagData {
+		return r.readTag(device, timeout)
+	}
+
+	uid, err := device.ReadUID(timeout)
+	if err != nil {
+		return nil, nil, translateMFRC522Error(err)
+	}
+	return uid, nil, nil
+}
+
+// readTag does the same as the driver's ReadUID but keeps the ATQA and SAK and, unlike the driver, fully
+// selects tags with 7 byte UIDs (NTAG/MIFARE Ultralight) so their memory can be read afterwards.
+func (r *mfrc522Reader) readTag(device *mfrc522.Dev, timeout time.Duration) ([]byte, *event.Tag, error) {
+	ll := device.LowLevel
+	if err := ll.WaitForEdge(timeout); err != nil {
+		return nil, nil, translateMFRC522Error(err)
+	}
+	if err := ll.Init(); err != nil {
+		return nil, nil, err
+	}
+	defer ll.ClearInterrupt()
+
+	// REQA, the only command sent with a 7 bit frame
+	if err := ll.DevWrite(commands.BitFramingReg, 0x07); err != nil {
+		return nil, nil, err
+	}
+	atqa, bits, err := ll.CardWrite(commands.PCD_TRANSCEIVE, []byte{commands.PICC_REQIDL})
+	if err != nil {
+		return nil, nil, translateMFRC522Error(err)
+	}
+	if bits != 0x10 || len(atqa) < 2 {
+		return nil, nil, fmt.Errorf("%w: mfrc522: wrong number of bits %v", ErrNoCard, bits)
+	}
+	if err := ll.DevWrite(commands.BitFramingReg, 0x00); err != nil {
+		return nil, nil, err
+	}
+
+	var uid []byte
+	var sak byte
+	// Cascade level 1, 2 then 3, a cascade tag (0x88) as the first byte means there's more of the UID
+	for _, level := range []byte{0x93, 0x95, 0x97} {
+		part, err := transceive(ll, []byte{level, 0x20}, false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("anticollision failed: %v", err)
+		}
+		if len(part) != 5 || part[0]^part[1]^part[2]^part[3] != part[4] {
+			return nil, nil, fmt.Errorf("anticollision failed: invalid response %X", part)
+		}
+
+		selected, err := transceive(ll, append([]byte{level, 0x70}, part...), true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("select failed: %v", err)
+		}
+		if len(selected) < 1 {
+			return nil, nil, errors.New("select failed: no SAK")
+		}
+		sak = selected[0]
+
+		if part[0] != 0x88 {
+			uid = append(uid, part[:4]...)
+			break
+		}
+		uid = append(uid, part[1:4]...)
+	}
+
+	tag := &event.Tag{ATQA: uint16(atqa[0]) | uint16(atqa[1])<<8, SAK: sak}
+	if err := readTagData(tag, func(page byte) ([]byte, error) {
+		return transceive(ll, []byte{ultralightRead, page}, true)
+	}); err != nil {
+		// The UID is still good, don't lose the read because of the rest of the tag
+		log.Warnf("readTag: unable to read the tag data of %v: %v", normalizeUID(uid), err)
+	}
+
+	if err := ll.StopCrypto(); err != nil {
+		return nil, nil, err
+	}
+	return uid, tag, nil
+}
+
+// transceive sends data to the tag (appending the CRC if needed) and returns the response
+func transceive(ll *commands.LowLevel, data []byte, withCRC bool) ([]byte, error) {
+	if withCRC {
+		crc, err := ll.CRC(data)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, crc[0], crc[1])
+	}
+	response, _, err := ll.CardWrite(commands.PCD_TRANSCEIVE, data)
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		// CardWrite returns nothing without an error when the error register is set
+		return nil, errors.New("no response from tag")
+	}
+	return response, nil
+}
+
+func (r *mfrc522Reader) reinit() error {
+	log.Debug("Re-initializing the MFRC522")
+	return r.device.Load().LowLevel.Init()
+}
+
+// selfTest reads the version register, a wedged chip or a broken SPI connection reads as all 0s or 1s
+func (r *mfrc522Reader) selfTest() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed.Load() {
+		return ErrHalted
+	}
+
+	device := r.device.Load()
+	if device == nil {
+		return errors.New("the MFRC522 is unavailable until it's recovered")
+	}
+	version, err := device.LowLevel.DevRead(commands.VersionReg)
+	if err != nil {
+		return fmt.Errorf("unable to read the MFRC522 version register: %v", err)
+	}
+	if version == 0x00 || version == 0xFF {
+		return fmt.Errorf("unexpected MFRC522 version %#02x", version)
+	}
+	log.Tracef("MFRC522 version %#02x", version)
+	return nil
+}
+
+// recover power cycles the MFRC522 through the reset pin and reopens the SPI port
+func (r *mfrc522Reader) recover() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed.Load() {
+		return ErrHalted
+	}
+
+	log.Debug("Power cycling the MFRC522")
+	// Halting stops the old driver, it can't be used again
+	r.halt(r.device.Swap(nil))
+	r.closePort()
+
+	if err := r.resetPin.Out(gpio.Low); err != nil {
+		return fmt.Errorf("unable to power down the MFRC522: %v", err)
+	}
+	time.Sleep(mfrc522ResetDelay)
+	if err := r.resetPin.Out(gpio.High); err != nil {
+		return fmt.Errorf("unable to power up the MFRC522: %v", err)
+	}
+	time.Sleep(mfrc522ResetDelay)
+
+	return r.open()
+}
+
+func (r *mfrc522Reader) stats() *readStats {
+	return &r.readStats
+}
+
+// translateMFRC522Error maps the errors from the mfrc522 driver, which are only distinguishable by their
+// message, to the ErrXXX errors
+func translateMFRC522Error(err error) error {
+	message := err.Error()
+	switch {
+	case message == "mfrc522 lowlevel: halt":
+		// The underlying card was halted, probably by the os signal handler
+		return fmt.Errorf("%w: %v", ErrHalted, err)
+	case message == "mfrc522 lowlevel: IRQ error":
+		// This is sometimes generated when there's not even a card to trigger the reading, re-initializing
+		// the device gets it reading again
+		return fmt.Errorf("%w: %v", ErrIRQ, err)
+	case strings.HasPrefix(message, "mfrc522 lowlevel: timeout waiting for IRQ edge"):
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	case message == "mfrc522: wrong number of bits 0":
+		// This happens when the reader pics up something it thinks is a PIC in the field but it's not
+		return fmt.Errorf("%w: %v", ErrNoCard, err)
+	}
+	return err
+}
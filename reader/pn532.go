@@ -0,0 +1,395 @@
+package reader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"periph.io/x/host/v3"
+
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+const (
+	PN532I2C  = "i2c"
+	PN532SPI  = "spi"
+	PN532UART = "uart"
+
+	pn532HostToPN532 = 0xD4
+	pn532PN532ToHost = 0xD5
+
+	pn532CmdGetFirmwareVersion   = 0x02
+	pn532CmdSAMConfiguration     = 0x14
+	pn532CmdRFConfiguration      = 0x32
+	pn532CmdInListPassiveTarget  = 0x4A
+	pn532CmdInDataExchange       = 0x40
+	pn532RFConfigMaxRetries      = 0x05
+	pn532BaudRate106kbpsTypeA    = 0x00
+	pn532PassiveActivationRetrys = 0x10
+
+	// How long to wait for the PN532 to acknowledge and answer a command outside of a read
+	pn532CommandTimeout = 1 * time.Second
+	// How long the response to an aborted command can take to turn up
+	pn532AbortTimeout = 2 * pn532ReadyPoll
+	// The largest frame we expect to read, responses to the commands we send are all much smaller
+	pn532MaxFrame = 64
+)
+
+// The host sends an ACK to abort the command the PN532 is running
+var pn532Ack = []byte{0x00, 0x00, 0xFF, 0x00, 0xFF, 0x00}
+
+// pn532Transport is the physical connection to the PN532 (I2C, SPI or UART), it only moves frames
+// around, building and parsing them is handled by pn532Reader.
+type pn532Transport interface {
+	writeFrame(frame []byte) error
+	// readFrame waits up to timeout for the PN532 to be ready and returns the raw bytes of the next frame
+	readFrame(timeout time.Duration) ([]byte, error)
+	Close() error
+}
+
+type pn532Reader struct {
+	readStats
+	config      Config
+	transport   pn532Transport
+	readTagData bool
+	closed      atomic.Bool
+	// A command timed out and was aborted, its response may still turn up
+	aborted bool
+	sync.Mutex
+}
+
+// NewPN532 creates a Reader backed by a PN532 connected over I2C, SPI or UART depending on config.PN532Interface
+func NewPN532(config Config) (Reader, error) {
+	log.Tracef("Creating new PN532 reader with interface='%v'", config.PN532Interface)
+
+	// Make sure periph is initialized.
+	if _, err := host.Init(); err != nil {
+		return nil, err
+	}
+
+	reader := &pn532Reader{config: config, readTagData: config.ReadTagData}
+	if err := reader.open(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// open connects the transport and initializes the PN532
+func (r *pn532Reader) open() error {
+	var transport pn532Transport
+	var err error
+	switch r.config.PN532Interface {
+	case PN532I2C:
+		transport, err = newPN532I2C(r.config.I2CBus, r.config.I2CAddress)
+	case PN532SPI:
+		transport, err = newPN532SPI(r.config.SPIBus, r.config.SPIDevice, r.config.SPISpeed)
+	case PN532UART:
+		transport, err = newPN532UART(r.config.UARTPort, r.config.UARTBaud)
+	default:
+		return fmt.Errorf("invalid value for reader-pn532-interface: '%v', must be one of: %v, %v, %v", r.config.PN532Interface, PN532I2C, PN532SPI, PN532UART)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.transport = transport
+	r.aborted = false
+	if err := r.init(); err != nil {
+		r.closeTransport()
+		return err
+	}
+	return nil
+}
+
+func (r *pn532Reader) closeTransport() {
+	if r.transport == nil {
+		// Already closed by a failed recovery
+		return
+	}
+	if err := r.transport.Close(); err != nil {
+		log.Warnf("closeTransport: failed to close transport: %v", err)
+	}
+	r.transport = nil
+}
+
+func (r *pn532Reader) init() error {
+	firmware, err := r.command(pn532CmdGetFirmwareVersion, nil, pn532CommandTimeout)
+	if err != nil {
+		return fmt.Errorf("unable to get PN532 firmware version: %v", err)
+	}
+	if len(firmware) < 4 {
+		return fmt.Errorf("unexpected PN532 firmware version response: %X", firmware)
+	}
+	log.Debugf("Found PN5%X firmware %v.%v", firmware[0], firmware[1], firmware[2])
+
+	// Normal mode, no virtual card timeout, no IRQ
+	if _, err := r.command(pn532CmdSAMConfiguration, []byte{0x01, 0x00, 0x00}, pn532CommandTimeout); err != nil {
+		return fmt.Errorf("unable to configure the PN532 SAM: %v", err)
+	}
+
+	// By default InListPassiveTarget retries forever, limit it so a read can be abandoned when the
+	// reader is closed or timed out
+	if _, err := r.command(pn532CmdRFConfiguration, []byte{pn532RFConfigMaxRetries, 0xFF, 0x01, pn532PassiveActivationRetrys}, pn532CommandTimeout); err != nil {
+		return fmt.Errorf("unable to configure the PN532 retries: %v", err)
+	}
+	return nil
+}
+
+func (r *pn532Reader) Close() {
+	log.Trace("Closing PN532 Reader")
+	r.closed.Store(true)
+
+	//Make sure to lock before we close the underlying transport so we don't close it mid-read
+	log.Trace("Acquiring the lock")
+	r.Lock()
+	defer r.Unlock()
+	log.Trace("Lock acquired")
+	r.closeTransport()
+	log.Trace("PN532 Reader closed")
+}
+
+func (r *pn532Reader) UID(ctx context.Context) (string, error) {
+	uid, _, err := readUID(ctx, r)
+	return uid, err
+}
+
+func (r *pn532Reader) ReadTag(ctx context.Context) (string, *event.Tag, error) {
+	return readUID(ctx, r)
+}
+
+func (r *pn532Reader) isClosed() bool {
+	return r.closed.Load()
+}
+
+func (r *pn532Reader) readUID(timeout time.Duration) ([]byte, *event.Tag, error) {
+	if r.transport == nil {
+		// A recovery failed, wait for the watchdog to try again
+		time.Sleep(timeout)
+		return nil, nil, fmt.Errorf("%w: the PN532 is unavailable until it's recovered", ErrTimeout)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !r.closed.Load() && time.Now().Before(deadline) {
+		// The PN532 carries on looking for a card for a while, only wait until the end of this attempt
+		response, err := r.command(pn532CmdInListPassiveTarget, []byte{0x01, pn532BaudRate106kbpsTypeA}, time.Until(deadline))
+		if err != nil {
+			if r.closed.Load() {
+				return nil, nil, fmt.Errorf("%w: %v", ErrHalted, err)
+			}
+			return nil, nil, translatePN532Error(err)
+		}
+
+		// NbTg, Tg, SENS_RES (2), SEL_RES, NFCIDLength, NFCID
+		if len(response) < 1 || response[0] == 0 {
+			// Nothing in the field yet
+			continue
+		}
+		if len(response) < 6 || len(response) < 6+int(response[5]) {
+			return nil, nil, fmt.Errorf("%w: pn532: unexpected InListPassiveTarget response: %X", ErrNoCard, response)
+		}
+		uid := response[6 : 6+int(response[5])]
+		if !r.readTagData {
+			return uid, nil, nil
+		}
+
+		// The PN532 leaves the tag selected so it can be read straight away. Reading it gets an attempt of its
+		// own, a card found at the end of this one would never have its data read otherwise.
+		tag := &event.Tag{ATQA: uint16(response[2])<<8 | uint16(response[3]), SAK: response[4]}
+		tagDeadline := time.Now().Add(timeout)
+		if err := readTagData(tag, func(page byte) ([]byte, error) {
+			return r.dataExchange(response[1], []byte{ultralightRead, page}, time.Until(tagDeadline))
+		}); err != nil {
+			// The UID is still good, don't lose the read because of the rest of the tag
+			log.Warnf("readUID: unable to read the tag data of %v: %v", normalizeUID(uid), err)
+		}
+		return uid, tag, nil
+	}
+
+	if r.closed.Load() {
+		return nil, nil, ErrHalted
+	}
+	return nil, nil, ErrTimeout
+}
+
+// dataExchange sends data to the target tg and returns its response
+func (r *pn532Reader) dataExchange(tg byte, data []byte, timeout time.Duration) ([]byte, error) {
+	response, err := r.command(pn532CmdInDataExchange, append([]byte{tg}, data...), timeout)
+	if err != nil {
+		return nil, err
+	}
+	// Status, data
+	if len(response) < 1 {
+		return nil, fmt.Errorf("pn532: unexpected InDataExchange response: %X", response)
+	}
+	if response[0]&0x3F != 0 {
+		return nil, fmt.Errorf("pn532: InDataExchange failed with status %#02x", response[0])
+	}
+	return response[1:], nil
+}
+
+func (r *pn532Reader) reinit() error {
+	log.Debug("Re-initializing the PN532")
+	return r.init()
+}
+
+// selfTest asks the PN532 for its firmware version
+func (r *pn532Reader) selfTest() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed.Load() {
+		return ErrHalted
+	}
+	if r.transport == nil {
+		return errors.New("the PN532 is unavailable until it's recovered")
+	}
+
+	if _, err := r.command(pn532CmdGetFirmwareVersion, nil, pn532CommandTimeout); err != nil {
+		return fmt.Errorf("unable to get PN532 firmware version: %v", err)
+	}
+	return nil
+}
+
+// recover reopens the transport and initializes the PN532 again
+func (r *pn532Reader) recover() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed.Load() {
+		return ErrHalted
+	}
+
+	log.Debug("Reopening the PN532")
+	r.closeTransport()
+	return r.open()
+}
+
+func (r *pn532Reader) stats() *readStats {
+	return &r.readStats
+}
+
+// command sends cmd with params and returns the data from the response (without the TFI and response code).
+// The ACK and the response must both arrive within timeout, otherwise the command is aborted.
+func (r *pn532Reader) command(cmd byte, params []byte, timeout time.Duration) ([]byte, error) {
+	if r.aborted {
+		r.drain()
+	}
+	deadline := time.Now().Add(timeout)
+	if err := r.transport.writeFrame(buildPN532Frame(append([]byte{pn532HostToPN532, cmd}, params...))); err != nil {
+		return nil, err
+	}
+
+	ack, err := r.readFrame(deadline)
+	if err != nil {
+		return nil, err
+	}
+	if !isPN532Ack(ack) {
+		return nil, fmt.Errorf("%w, expected ACK but received %X", errPN532Frame, ack)
+	}
+
+	frame, err := r.readFrame(deadline)
+	if err != nil {
+		return nil, err
+	}
+	data, err := parsePN532Frame(frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || data[0] != pn532PN532ToHost || data[1] != cmd+1 {
+		return nil, fmt.Errorf("%w, unexpected response to command %#02x: %X", errPN532Frame, cmd, data)
+	}
+	return data[2:], nil
+}
+
+// readFrame reads the next frame, aborting the command if it doesn't arrive before deadline
+func (r *pn532Reader) readFrame(deadline time.Time) ([]byte, error) {
+	frame, err := r.transport.readFrame(time.Until(deadline))
+	if errors.Is(err, errPN532NotReady) {
+		r.abort()
+	}
+	return frame, err
+}
+
+// abort stops the command the PN532 is running, its response may already be on the way so it's drained
+// before the next command rather than mistaken for the response to that one
+func (r *pn532Reader) abort() {
+	r.aborted = true
+	if err := r.transport.writeFrame(pn532Ack); err != nil {
+		log.Debugf("abort: unable to abort the PN532 command: %v", err)
+	}
+}
+
+// drain discards what's left of an aborted command, at most its ACK and its response
+func (r *pn532Reader) drain() {
+	r.aborted = false
+	for i := 0; i < 2; i++ {
+		frame, err := r.transport.readFrame(pn532AbortTimeout)
+		if err != nil {
+			// Usually errPN532NotReady, i.e. there's nothing left, anything else turns up in the next command
+			return
+		}
+		log.Tracef("drain: discarded %X from an aborted command", frame)
+	}
+}
+
+// buildPN532Frame wraps data (TFI, command and parameters) in a normal information frame
+func buildPN532Frame(data []byte) []byte {
+	length := byte(len(data))
+	frame := []byte{0x00, 0x00, 0xFF, length, ^length + 1}
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	frame = append(frame, data...)
+	return append(frame, ^sum+1, 0x00)
+}
+
+// isPN532Ack returns true if frame is an ACK frame (00 00 FF 00 FF 00)
+func isPN532Ack(frame []byte) bool {
+	start := bytes.Index(frame, []byte{0x00, 0xFF})
+	return start >= 0 && len(frame) >= start+4 && frame[start+2] == 0x00 && frame[start+3] == 0xFF
+}
+
+// parsePN532Frame validates a normal information frame and returns its data (TFI, response code and parameters)
+func parsePN532Frame(frame []byte) ([]byte, error) {
+	start := bytes.Index(frame, []byte{0x00, 0xFF})
+	if start < 0 || len(frame) < start+4 {
+		return nil, fmt.Errorf("%w, no frame found in %X", errPN532Frame, frame)
+	}
+	frame = frame[start+2:]
+
+	length := frame[0]
+	if length+frame[1] != 0 {
+		return nil, fmt.Errorf("%w, invalid length checksum in %X", errPN532Frame, frame)
+	}
+	if len(frame) < int(length)+3 {
+		return nil, fmt.Errorf("%w, truncated frame %X", errPN532Frame, frame)
+	}
+
+	data := frame[2 : 2+int(length)]
+	sum := frame[2+int(length)]
+	for _, b := range data {
+		sum += b
+	}
+	if sum != 0 {
+		return nil, fmt.Errorf("%w, invalid data checksum in %X", errPN532Frame, frame)
+	}
+	return data, nil
+}
+
+// translatePN532Error maps the errors from a PN532 command to the errors readUID knows how to handle, the
+// same as translateMFRC522Error does for the MFRC522
+func translatePN532Error(err error) error {
+	switch {
+	case errors.Is(err, errPN532NotReady):
+		// Nothing came back in time, e.g. the PN532 is still busy looking for a card
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	case errors.Is(err, errPN532Frame):
+		// Re-initializing the PN532 gets the host and the PN532 back in step
+		return fmt.Errorf("%w: %v", ErrIRQ, err)
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package reader
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	pn532NoTarget = buildPN532Frame([]byte{pn532PN532ToHost, pn532CmdInListPassiveTarget + 1, 0x00})
+	pn532Firmware = buildPN532Frame([]byte{pn532PN532ToHost, pn532CmdGetFirmwareVersion + 1, 0x32, 0x01, 0x06, 0x07})
+)
+
+type pendingFrame struct {
+	frame   []byte
+	readyAt time.Time
+}
+
+// fakePN532 ACKs every command straight away and answers it after the delay set for that command, the
+// answer to an aborted command is still sent like a PN532 which had already finished it would
+type fakePN532 struct {
+	lock      sync.Mutex
+	delays    map[byte]time.Duration
+	responses map[byte][]byte
+	pending   []pendingFrame
+	aborts    int
+}
+
+func newFakePN532() *fakePN532 {
+	return &fakePN532{
+		delays: make(map[byte]time.Duration),
+		responses: map[byte][]byte{
+			pn532CmdInListPassiveTarget: pn532NoTarget,
+			pn532CmdGetFirmwareVersion:  pn532Firmware,
+		},
+	}
+}
+
+func (t *fakePN532) writeFrame(frame []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if bytes.Equal(frame, pn532Ack) {
+		t.aborts++
+		return nil
+	}
+	data, err := parsePN532Frame(frame)
+	if err != nil {
+		return err
+	}
+	cmd := data[1]
+	now := time.Now()
+	t.pending = append(t.pending,
+		pendingFrame{frame: pn532Ack, readyAt: now},
+		pendingFrame{frame: t.responses[cmd], readyAt: now.Add(t.delays[cmd])})
+	return nil
+}
+
+func (t *fakePN532) readFrame(timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		t.lock.Lock()
+		if len(t.pending) > 0 && !time.Now().Before(t.pending[0].readyAt) {
+			frame := t.pending[0].frame
+			t.pending = t.pending[1:]
+			t.lock.Unlock()
+			return frame, nil
+		}
+		t.lock.Unlock()
+		if time.Now().After(deadline) {
+			return nil, errPN532NotReady
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *fakePN532) Close() error {
+	return nil
+}
+
+func (t *fakePN532) abortCount() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.aborts
+}
+
+func TestPN532CommandTimeoutDrainsStaleResponse(t *testing.T) {
+	transport := newFakePN532()
+	transport.delays[pn532CmdInListPassiveTarget] = 50 * time.Millisecond
+	r := &pn532Reader{transport: transport}
+
+	start := time.Now()
+	if _, err := r.command(pn532CmdInListPassiveTarget, []byte{0x01, pn532BaudRate106kbpsTypeA}, 10*time.Millisecond); !errors.Is(err, errPN532NotReady) {
+		t.Fatalf("command: got %v, want %v", err, errPN532NotReady)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("command waited %v, want about 10ms", elapsed)
+	}
+	if aborts := transport.abortCount(); aborts != 1 {
+		t.Errorf("the command was aborted %v times, want 1", aborts)
+	}
+
+	// The response to the aborted command turns up before the next command is sent
+	time.Sleep(60 * time.Millisecond)
+	firmware, err := r.command(pn532CmdGetFirmwareVersion, nil, pn532CommandTimeout)
+	if err != nil {
+		t.Fatalf("command after an abort: %v", err)
+	}
+	if !bytes.Equal(firmware, []byte{0x32, 0x01, 0x06, 0x07}) {
+		t.Errorf("got firmware %X, want 32010607", firmware)
+	}
+}
+
+func TestPN532ReadUIDHonoursTimeout(t *testing.T) {
+	transport := newFakePN532()
+	// Longer than the attempt, the PN532 is still looking for a card when the attempt ends
+	transport.delays[pn532CmdInListPassiveTarget] = time.Second
+	r := &pn532Reader{transport: transport}
+
+	start := time.Now()
+	if _, _, err := r.readUID(20 * time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("readUID: got %v, want %v", err, ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("readUID took %v, want about 20ms", elapsed)
+	}
+}
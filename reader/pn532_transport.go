@@ -0,0 +1,292 @@
+package reader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/i2c/i2creg"
+	"periph.io/x/conn/v3/physic"
+	"periph.io/x/conn/v3/spi"
+	"periph.io/x/conn/v3/spi/spireg"
+)
+
+const (
+	// How often to check if the PN532 has a response ready
+	pn532ReadyPoll = 10 * time.Millisecond
+
+	pn532SPIDataWrite  = 0x01
+	pn532SPIStatusRead = 0x02
+	pn532SPIDataRead   = 0x03
+)
+
+var (
+	errPN532NotReady = errors.New("pn532: timed out waiting for the device to be ready")
+	// A frame from the PN532 was corrupt or not the one expected, the host and the PN532 are out of step
+	errPN532Frame  = errors.New("pn532: bad frame")
+	pn532UARTBauds = map[int]uint32{
+		9600:   unix.B9600,
+		19200:  unix.B19200,
+		38400:  unix.B38400,
+		57600:  unix.B57600,
+		115200: unix.B115200,
+		230400: unix.B230400,
+		460800: unix.B460800,
+		921600: unix.B921600,
+	}
+)
+
+// pn532I2C talks to the PN532 over I2C, every read starts with a status byte which is 0x01 once
+// the PN532 has a frame ready
+type pn532I2C struct {
+	bus i2c.BusCloser
+	dev *i2c.Dev
+}
+
+func newPN532I2C(busName string, address int) (pn532Transport, error) {
+	if address < 0 || address > 0x7F {
+		return nil, fmt.Errorf("invalid value for reader-i2c-address: '%v', must be between 0 and 127 inclusive", address)
+	}
+	bus, err := i2creg.Open(busName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for reader-i2c-bus: unable to open '%v': %v", busName, err)
+	}
+	return &pn532I2C{bus: bus, dev: &i2c.Dev{Bus: bus, Addr: uint16(address)}}, nil
+}
+
+func (t *pn532I2C) writeFrame(frame []byte) error {
+	return t.dev.Tx(frame, nil)
+}
+
+func (t *pn532I2C) readFrame(timeout time.Duration) ([]byte, error) {
+	read := make([]byte, pn532MaxFrame+1)
+	if err := waitForPN532(timeout, func() (bool, error) {
+		if err := t.dev.Tx(nil, read); err != nil {
+			return false, err
+		}
+		return read[0]&0x01 == 0x01, nil
+	}); err != nil {
+		return nil, err
+	}
+	// Skip the status byte
+	return read[1:], nil
+}
+
+func (t *pn532I2C) Close() error {
+	return t.bus.Close()
+}
+
+// pn532SPI talks to the PN532 over SPI, each transfer starts with an operation byte. The PN532 expects
+// the bits of each byte least significant first which most SPI controllers (including the Pi's) can't
+// do so the bytes are reversed in software.
+type pn532SPI struct {
+	port spi.PortCloser
+	conn spi.Conn
+}
+
+func newPN532SPI(spiBus int, spiDevice int, spiSpeed string) (pn532Transport, error) {
+	var speed physic.Frequency
+	if err := speed.Set(spiSpeed); err != nil {
+		return nil, fmt.Errorf("invalid value for reader-spi-speed: '%v': %v", spiSpeed, err)
+	}
+	if speed <= 0 {
+		return nil, fmt.Errorf("invalid value for reader-spi-speed: '%v', must be greater than 0", spiSpeed)
+	}
+
+	spiPort := fmt.Sprintf("SPI%v.%v", spiBus, spiDevice)
+	port, err := spireg.Open(spiPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for reader-spi-bus/reader-spi-device: unable to open '%v': %v", spiPort, err)
+	}
+
+	conn, err := port.Connect(speed, spi.Mode0, 8)
+	if err != nil {
+		closePN532Port(port)
+		return nil, err
+	}
+	return &pn532SPI{port: port, conn: conn}, nil
+}
+
+func (t *pn532SPI) tx(w []byte, r []byte) error {
+	reversed := make([]byte, len(w))
+	for i, b := range w {
+		reversed[i] = bits.Reverse8(b)
+	}
+	if err := t.conn.Tx(reversed, r); err != nil {
+		return err
+	}
+	for i, b := range r {
+		r[i] = bits.Reverse8(b)
+	}
+	return nil
+}
+
+func (t *pn532SPI) writeFrame(frame []byte) error {
+	return t.tx(append([]byte{pn532SPIDataWrite}, frame...), nil)
+}
+
+func (t *pn532SPI) readFrame(timeout time.Duration) ([]byte, error) {
+	status := make([]byte, 2)
+	if err := waitForPN532(timeout, func() (bool, error) {
+		if err := t.tx([]byte{pn532SPIStatusRead, 0x00}, status); err != nil {
+			return false, err
+		}
+		return status[1]&0x01 == 0x01, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	w := make([]byte, pn532MaxFrame+1)
+	w[0] = pn532SPIDataRead
+	read := make([]byte, len(w))
+	if err := t.tx(w, read); err != nil {
+		return nil, err
+	}
+	// Skip the byte clocked in while the operation was sent
+	return read[1:], nil
+}
+
+func (t *pn532SPI) Close() error {
+	return t.port.Close()
+}
+
+// pn532UART talks to the PN532 over its high speed UART, frames are simply streamed in both directions
+type pn532UART struct {
+	port *os.File
+}
+
+func newPN532UART(portName string, baud int) (pn532Transport, error) {
+	speed, exists := pn532UARTBauds[baud]
+	if !exists {
+		return nil, fmt.Errorf("invalid value for reader-uart-baud: '%v', unsupported baud rate", baud)
+	}
+
+	port, err := os.OpenFile(portName, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for reader-uart-port: '%v': %v", portName, err)
+	}
+
+	t := &pn532UART{port: port}
+	if err := t.configure(speed); err != nil {
+		closePN532Port(port)
+		return nil, fmt.Errorf("invalid value for reader-uart-port: unable to configure '%v': %v", portName, err)
+	}
+
+	// The PN532 starts in low power mode, a long preamble wakes it up
+	if _, err := port.Write([]byte{0x55, 0x55, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		closePN532Port(port)
+		return nil, err
+	}
+	return t, nil
+}
+
+// configure puts the port in raw 8N1 mode at speed
+func (t *pn532UART) configure(speed uint32) error {
+	conn, err := t.port.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var termiosErr error
+	if err := conn.Control(func(fd uintptr) {
+		termios, err := unix.IoctlGetTermios(int(fd), unix.TCGETS)
+		if err != nil {
+			termiosErr = err
+			return
+		}
+		termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		termios.Oflag &^= unix.OPOST
+		termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		termios.Cflag &^= unix.CSIZE | unix.PARENB | unix.CBAUD
+		termios.Cflag |= unix.CS8 | unix.CLOCAL | unix.CREAD | speed
+		termios.Ispeed = speed
+		termios.Ospeed = speed
+		termiosErr = unix.IoctlSetTermios(int(fd), unix.TCSETS, termios)
+	}); err != nil {
+		return err
+	}
+	return termiosErr
+}
+
+func (t *pn532UART) writeFrame(frame []byte) error {
+	_, err := t.port.Write(frame)
+	return err
+}
+
+func (t *pn532UART) readFrame(timeout time.Duration) ([]byte, error) {
+	if err := t.port.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	// Read until the start code, then the length which tells us how much more to read
+	var frame []byte
+	b := make([]byte, 1)
+	for len(frame) < 2 || frame[len(frame)-2] != 0x00 || frame[len(frame)-1] != 0xFF {
+		if _, err := io.ReadFull(t.port, b); err != nil {
+			return nil, uartReadError(err)
+		}
+		frame = append(frame, b[0])
+	}
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(t.port, header); err != nil {
+		return nil, uartReadError(err)
+	}
+	frame = append(frame, header...)
+	if header[0] == 0x00 && header[1] == 0xFF {
+		// ACK, only the postamble is left
+		postamble := make([]byte, 1)
+		if _, err := io.ReadFull(t.port, postamble); err != nil {
+			return nil, uartReadError(err)
+		}
+		return append(frame, postamble...), nil
+	}
+
+	// Data, checksum and postamble
+	rest := make([]byte, int(header[0])+2)
+	if _, err := io.ReadFull(t.port, rest); err != nil {
+		return nil, uartReadError(err)
+	}
+	return append(frame, rest...), nil
+}
+
+func (t *pn532UART) Close() error {
+	return t.port.Close()
+}
+
+func closePN532Port(port io.Closer) {
+	if err := port.Close(); err != nil {
+		log.Warnf("closePN532Port: failed to close port: %v", err)
+	}
+}
+
+func uartReadError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return errPN532NotReady
+	}
+	return err
+}
+
+// waitForPN532 calls ready until it returns true or the timeout expires
+func waitForPN532(timeout time.Duration, ready func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		isReady, err := ready()
+		if err != nil {
+			return err
+		}
+		if isReady {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errPN532NotReady
+		}
+		time.Sleep(pn532ReadyPoll)
+	}
+}
@@ -0,0 +1,129 @@
+package reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+type PresenceType int
+
+const (
+	PRESENTED PresenceType = iota
+	REMOVED
+)
+
+var presenceTypeToString = map[PresenceType]string{
+	PRESENTED: "PRESENTED",
+	REMOVED:   "REMOVED",
+}
+
+func (pt PresenceType) String() string {
+	return presenceTypeToString[pt]
+}
+
+type PresenceEvent struct {
+	Type PresenceType
+	UID  string
+	// What was read from the tag when it was PRESENTED, nil if the reader doesn't read tag data
+	Tag *event.Tag
+}
+
+// PresenceTracker turns the stream of raw reads into PRESENTED/REMOVED events. While a band is held
+// over the reader it is read over and over, the tracker only reports it once when it enters the field
+// and reports it again as REMOVED once it has been missing for removalPolls consecutive polls.
+type PresenceTracker struct {
+	reader       Reader
+	pollTimeout  time.Duration
+	removalPolls int
+	present      string
+	misses       int
+	pending      []PresenceEvent
+}
+
+func NewPresenceTracker(reader Reader, pollTimeout time.Duration, removalPolls int) (*PresenceTracker, error) {
+	log.Tracef("Creating new PresenceTracker with pollTimeout=%v, removalPolls=%v", pollTimeout, removalPolls)
+	if pollTimeout <= 0 {
+		return nil, fmt.Errorf("invalid value for reader-poll-timeout: '%v', must be greater than 0", pollTimeout)
+	}
+	if removalPolls < 1 {
+		return nil, fmt.Errorf("invalid value for reader-removal-polls: '%v', must be 1 or greater", removalPolls)
+	}
+	return &PresenceTracker{reader: reader, pollTimeout: pollTimeout, removalPolls: removalPolls}, nil
+}
+
+// Next polls the reader until the presence of a band changes or ctx is done. ErrHalted is returned once
+// the reader is shutdown.
+func (t *PresenceTracker) Next(ctx context.Context) (*PresenceEvent, error) {
+	for len(t.pending) == 0 {
+		uid, tag, err := t.poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !errors.Is(err, ErrTimeout) {
+				return nil, err
+			}
+			// Nothing in the field for this poll
+			uid = ""
+		}
+		t.pending = t.observe(uid, tag)
+	}
+
+	next := t.pending[0]
+	t.pending = t.pending[1:]
+	return &next, nil
+}
+
+func (t *PresenceTracker) poll(ctx context.Context) (string, *event.Tag, error) {
+	pollCtx, cancel := context.WithTimeout(ctx, t.pollTimeout)
+	defer cancel()
+	if tagReader, ok := t.reader.(TagReader); ok {
+		return tagReader.ReadTag(pollCtx)
+	}
+	uid, err := t.reader.UID(pollCtx)
+	return uid, nil, err
+}
+
+// Present returns the UID currently in the field or "" if there isn't one
+func (t *PresenceTracker) Present() string {
+	return t.present
+}
+
+// observe records the result of a single poll, uid is "" when nothing was read, and returns the
+// resulting presence changes (if any)
+func (t *PresenceTracker) observe(uid string, tag *event.Tag) []PresenceEvent {
+	if uid == "" {
+		if t.present == "" {
+			return nil
+		}
+		t.misses++
+		if t.misses < t.removalPolls {
+			return nil
+		}
+		removed := t.present
+		t.present = ""
+		t.misses = 0
+		log.Tracef("%v missing for %v polls, removed", removed, t.removalPolls)
+		return []PresenceEvent{{Type: REMOVED, UID: removed}}
+	}
+
+	t.misses = 0
+	if uid == t.present {
+		// Still holding the same band
+		return nil
+	}
+
+	var events []PresenceEvent
+	if t.present != "" {
+		// A different band showed up before the first was considered removed
+		events = append(events, PresenceEvent{Type: REMOVED, UID: t.present})
+	}
+	t.present = uid
+	return append(events, PresenceEvent{Type: PRESENTED, UID: uid, Tag: tag})
+}
@@ -0,0 +1,139 @@
+package reader
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// scriptedReader returns one scripted poll per call to UID, "" is a poll where nothing was in the field.
+// It reports ErrHalted once the script runs out.
+type scriptedReader struct {
+	polls []string
+}
+
+func (r *scriptedReader) UID(ctx context.Context) (string, error) {
+	if len(r.polls) == 0 {
+		return "", ErrHalted
+	}
+	uid := r.polls[0]
+	r.polls = r.polls[1:]
+	if uid == "" {
+		return "", ErrTimeout
+	}
+	return uid, nil
+}
+
+func (r *scriptedReader) Stats() Stats {
+	return Stats{}
+}
+
+func (r *scriptedReader) Close() {}
+
+func TestPresenceTracker(t *testing.T) {
+	tests := []struct {
+		name         string
+		removalPolls int
+		polls        []string
+		want         []PresenceEvent
+	}{
+		{
+			name:         "presented",
+			removalPolls: 3,
+			polls:        []string{"", "", "04A1B2C3"},
+			want:         []PresenceEvent{{Type: PRESENTED, UID: "04A1B2C3"}},
+		},
+		{
+			name:         "held",
+			removalPolls: 3,
+			polls:        []string{"04A1B2C3", "04A1B2C3", "", "", "04A1B2C3", "04A1B2C3"},
+			want:         []PresenceEvent{{Type: PRESENTED, UID: "04A1B2C3"}},
+		},
+		{
+			name:         "removed",
+			removalPolls: 3,
+			polls:        []string{"04A1B2C3", "", "", "", ""},
+			want: []PresenceEvent{
+				{Type: PRESENTED, UID: "04A1B2C3"},
+				{Type: REMOVED, UID: "04A1B2C3"},
+			},
+		},
+		{
+			name:         "tapped again after removal",
+			removalPolls: 1,
+			polls:        []string{"04A1B2C3", "", "04A1B2C3"},
+			want: []PresenceEvent{
+				{Type: PRESENTED, UID: "04A1B2C3"},
+				{Type: REMOVED, UID: "04A1B2C3"},
+				{Type: PRESENTED, UID: "04A1B2C3"},
+			},
+		},
+		{
+			name:         "swapped",
+			removalPolls: 3,
+			polls:        []string{"04A1B2C3", "04A1B2C3", "", "04D5E6F7", "04D5E6F7"},
+			want: []PresenceEvent{
+				{Type: PRESENTED, UID: "04A1B2C3"},
+				{Type: REMOVED, UID: "04A1B2C3"},
+				{Type: PRESENTED, UID: "04D5E6F7"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker, err := NewPresenceTracker(&scriptedReader{polls: test.polls}, time.Second, test.removalPolls)
+			if err != nil {
+				t.Fatalf("NewPresenceTracker: %v", err)
+			}
+
+			var got []PresenceEvent
+			for {
+				e, err := tracker.Next(context.Background())
+				if errors.Is(err, ErrHalted) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next: unexpected error: %v", err)
+				}
+				got = append(got, *e)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got events %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPresenceTrackerPresent(t *testing.T) {
+	tracker, err := NewPresenceTracker(&scriptedReader{polls: []string{"04A1B2C3", "", ""}}, time.Second, 2)
+	if err != nil {
+		t.Fatalf("NewPresenceTracker: %v", err)
+	}
+
+	if _, err := tracker.Next(context.Background()); err != nil {
+		t.Fatalf("Next: unexpected error: %v", err)
+	}
+	if got := tracker.Present(); got != "04A1B2C3" {
+		t.Errorf("Present() after PRESENTED = '%v', want '04A1B2C3'", got)
+	}
+
+	if _, err := tracker.Next(context.Background()); err != nil {
+		t.Fatalf("Next: unexpected error: %v", err)
+	}
+	if got := tracker.Present(); got != "" {
+		t.Errorf("Present() after REMOVED = '%v', want ''", got)
+	}
+}
+
+func TestNewPresenceTrackerInvalid(t *testing.T) {
+	if _, err := NewPresenceTracker(&scriptedReader{}, 0, 1); err == nil {
+		t.Error("expected an error for a poll timeout of 0")
+	}
+	if _, err := NewPresenceTracker(&scriptedReader{}, time.Second, 0); err == nil {
+		t.Error("expected an error for 0 removal polls")
+	}
+}
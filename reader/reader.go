@@ -0,0 +1,194 @@
+package reader
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+const (
+	// The longest a single hardware read is allowed to block, this bounds how long it takes to notice
+	// a cancelled context
+	maxReadAttempt = 250 * time.Millisecond
+
+	EvdevType     = "evdev"
+	MFRC522Type   = "mfrc522"
+	PN532Type     = "pn532"
+	SimulatedType = "simulated"
+)
+
+type Reader interface {
+	// UID blocks until a UID is read, it returns ErrTimeout if the ctx deadline expires first, the ctx error
+	// if ctx is cancelled and ErrHalted once the reader is closed
+	UID(ctx context.Context) (string, error)
+	Stats() Stats
+	Close()
+}
+
+// Config holds the settings for every backend, each backend only looks at the fields it needs.
+type Config struct {
+	// The backend to create, one of the XXXType constants
+	Type string
+	// Where the simulated reader gets UIDs from: '-' for stdin, the path to a FIFO or the path to a timeline file
+	SimulatedSource string
+	// The input device of a keyboard wedge reader, whether to grab it exclusively and how it types the UID
+	// (one of the EvdevXXX constants)
+	EvdevDevice    string
+	EvdevGrab      bool
+	EvdevUIDFormat string
+	// How the PN532 is connected, one of the PN532XXX constants
+	PN532Interface string
+	// The periph name of the I2C bus and the address of the PN532 when connected over I2C
+	I2CBus     string
+	I2CAddress int
+	// The serial device and baud rate of the PN532 when connected over UART
+	UARTPort string
+	UARTBaud int
+	// The SPI bus and device (chip select) the MFRC522 or PN532 is connected to
+	SPIBus    int
+	SPIDevice int
+	// The SPI clock speed (e.g. '10MHz'), for the MFRC522 this is the maximum
+	SPISpeed string
+	// The periph names (e.g. 'GPIO25') of the reset and IRQ pins
+	ResetPin string
+	IRQPin   string
+	// The antenna gain, 0 to 7 inclusive
+	AntennaGain int
+	// Whether to read the tag type and NTAG/MIFARE Ultralight user memory along with the UID (MFRC522 and
+	// PN532 only)
+	ReadTagData bool
+}
+
+// New creates the Reader backend selected by config.Type
+func New(config Config) (Reader, error) {
+	log.Tracef("Creating new reader with config: %+v", config)
+	switch config.Type {
+	case MFRC522Type:
+		return NewMFRC522(config)
+	case PN532Type:
+		return NewPN532(config)
+	case EvdevType:
+		return NewEvdev(config.EvdevDevice, config.EvdevGrab, config.EvdevUIDFormat)
+	case SimulatedType:
+		return NewSimulated(config.SimulatedSource)
+	default:
+		return nil, fmt.Errorf("invalid value for reader-type: '%v', must be one of: %v, %v, %v, %v", config.Type, EvdevType, MFRC522Type, PN532Type, SimulatedType)
+	}
+}
+
+// device is implemented by the hardware backends so they share the same read loop and error handling
+type device interface {
+	sync.Locker
+	isClosed() bool
+	// readUID blocks until a card is read, the timeout expires or the device is halted, failures are
+	// reported using the ErrXXX errors where possible. The tag is only returned if the device was
+	// configured to read tag data.
+	readUID(timeout time.Duration) ([]byte, *event.Tag, error)
+	// reinit puts the device back into a known good state after an ErrIRQ
+	reinit() error
+	stats() *readStats
+}
+
+// readUID reads from d until a UID is found, ctx is done or the device is halted. Each attempt is
+// bounded by maxReadAttempt so cancellation is noticed promptly without needing a separate goroutine.
+func readUID(ctx context.Context, d device) (string, *event.Tag, error) {
+	stats := d.stats()
+	for {
+		if d.isClosed() {
+			return "", nil, ErrHalted
+		}
+		if err := contextError(ctx); err != nil {
+			return "", nil, err
+		}
+
+		uid, tag, err := readAttempt(ctx, d)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrHalted):
+				return "", nil, err
+			case errors.Is(err, ErrTimeout):
+				// Only this attempt timed out, the ctx is checked at the top of the loop
+				continue
+			case errors.Is(err, ErrIRQ):
+				current := stats.Stats()
+				log.Debugf("readUID: %v, re-initialized the reader (IRQ errors: %v, re-inits: %v)", err, current.IRQErrors, current.Reinits)
+				continue
+			case errors.Is(err, ErrNoCard):
+				stats.noCardErrors.Add(1)
+				log.Tracef("readUID: %v", err)
+				continue
+			}
+
+			// Not sure what the error is, we should just try to read again
+			stats.retries.Add(1)
+			log.Warnf("readUID: Unexpected error, retrying (retries: %v): %v", stats.retries.Load(), err)
+			continue
+		}
+
+		log.Tracef("Read UID %v, tag: %v", uid, tag)
+		stats.reads.Add(1)
+		return normalizeUID(uid), tag, nil
+	}
+}
+
+// readAttempt makes a single read while holding the device lock
+func readAttempt(ctx context.Context, d device) ([]byte, *event.Tag, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.isClosed() {
+		return nil, nil, ErrHalted
+	}
+
+	timeout := maxReadAttempt
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+
+	uid, tag, err := d.readUID(timeout)
+	if errors.Is(err, ErrIRQ) {
+		// Re-initialize while we still hold the lock so nothing else touches the device in the meantime
+		stats := d.stats()
+		stats.irqErrors.Add(1)
+		stats.reinits.Add(1)
+		if err := d.reinit(); err != nil {
+			log.Errorf("readUID: failed to re-initialize the reader after an IRQ error: %v", err)
+		}
+	}
+	return uid, tag, err
+}
+
+// contextError maps a done ctx to the error UID should return, ErrTimeout for an expired deadline
+func contextError(ctx context.Context) error {
+	switch err := ctx.Err(); {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrTimeout
+	default:
+		return err
+	}
+}
+
+// normalizeUID converts the raw UID bytes into the upper-case hex format used everywhere else
+func normalizeUID(uid []byte) string {
+	return strings.ToUpper(hex.EncodeToString(uid))
+}
+
+// ParseUID converts a hex UID which didn't come from a reader (e.g. a simulated read) into the format the
+// readers report
+func ParseUID(uid string) (string, error) {
+	decoded, err := hex.DecodeString(uid)
+	if err != nil {
+		return "", fmt.Errorf("uid is not valid hex: %v", err)
+	}
+	if len(decoded) == 0 {
+		return "", errors.New("uid is empty")
+	}
+	return normalizeUID(decoded), nil
+}
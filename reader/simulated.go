@@ -0,0 +1,162 @@
+package reader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	stdinSource = "-"
+	// How long Close waits for the source to stop being read
+	simulatedCloseTimeout = 1 * time.Second
+)
+
+// simulatedReader reads UIDs from a text source instead of hardware so the rest of the application
+// can run on machines without an MFRC522 attached (e.g. a dev laptop or CI).
+//
+// The source is read line by line, each line is either a UID (hex) or a delay followed by a UID
+// (e.g. '2s 04A1B2C3D4E5F6'). The delay is a Go duration and is waited before the UID is emitted,
+// this allows a file to describe a timeline of reads. Blank lines and lines starting with '#' are ignored.
+type simulatedReader struct {
+	*uidStream
+	source string
+	closer io.Closer
+	// Closed once run has returned
+	finished chan struct{}
+}
+
+// NewSimulated creates a Reader which takes UIDs from source. source can be '-' for stdin, the path to a
+// FIFO (which is kept open across writers) or the path to a regular timeline file.
+func NewSimulated(source string) (Reader, error) {
+	log.Tracef("Creating new simulated reader with source='%v'", source)
+	r := &simulatedReader{
+		uidStream: newUIDStream(),
+		source:    source,
+		finished:  make(chan struct{}),
+	}
+
+	in, err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	r.closer = in
+
+	go r.run(in)
+	return r, nil
+}
+
+func (r *simulatedReader) open() (io.ReadCloser, error) {
+	if r.source == stdinSource {
+		return openStdin()
+	}
+
+	info, err := os.Stat(r.source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for reader-simulated-source: '%v': %v", r.source, err)
+	}
+
+	if info.Mode()&os.ModeNamedPipe != 0 {
+		// Opening the FIFO read/write means the open doesn't block waiting for a writer and we
+		// never see EOF when a writer goes away, the next writer just picks up where the last left off
+		return os.OpenFile(r.source, os.O_RDWR, 0)
+	}
+	return os.Open(r.source)
+}
+
+// openStdin returns a copy of stdin which Close can interrupt, closing os.Stdin itself wouldn't stop a
+// read in progress. The copy is non-blocking so reads go through the runtime poller (for a pipe or a
+// terminal, a file never blocks anyway). The daemon doesn't read stdin anywhere else.
+func openStdin() (io.ReadCloser, error) {
+	fd, err := unix.Dup(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for reader-simulated-source: unable to read stdin: %v", err)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("invalid value for reader-simulated-source: unable to read stdin: %v", err)
+	}
+	return os.NewFile(uintptr(fd), "stdin"), nil
+}
+
+func (r *simulatedReader) run(in io.Reader) {
+	defer close(r.finished)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		delay, uid, err := parseSimulatedLine(line)
+		if err != nil {
+			log.Warnf("simulatedReader: ignoring line '%v': %v", line, err)
+			continue
+		}
+
+		if delay > 0 && !r.sleep(delay) {
+			return
+		}
+
+		log.Tracef("Simulated UID %v", uid)
+		if !r.send(uid) {
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		// The source is closed underneath us by Close
+		if !r.isShutdown() {
+			log.Errorf("simulatedReader: error reading from '%v': %v", r.source, err)
+		}
+		return
+	}
+	log.Infof("simulatedReader: reached the end of '%v', no more UIDs will be read", r.source)
+}
+
+func parseSimulatedLine(line string) (time.Duration, string, error) {
+	var delay time.Duration
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 1:
+	case 2:
+		d, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return 0, "", err
+		}
+		delay = d
+		fields = fields[1:]
+	default:
+		return 0, "", fmt.Errorf("expected '[delay] uid' but found %v fields", len(fields))
+	}
+
+	uid, err := ParseUID(fields[0])
+	if err != nil {
+		return 0, "", err
+	}
+	return delay, uid, nil
+}
+
+func (r *simulatedReader) Close() {
+	log.Trace("Closing simulated reader")
+	r.shutdown(func() {
+		if err := r.closer.Close(); err != nil {
+			log.Warnf("Close: failed to close '%v': %v", r.source, err)
+		}
+	})
+
+	timer := time.NewTimer(simulatedCloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-r.finished:
+	case <-timer.C:
+		log.Warnf("Close: '%v' is still being read %v after it was closed", r.source, simulatedCloseTimeout)
+	}
+	log.Trace("Simulated reader closed")
+}
@@ -0,0 +1,76 @@
+package reader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// uidStream is shared by the backends which produce UIDs from their own goroutine (rather than
+// polling hardware on each call to UID), the goroutine sends UIDs and UID hands them out.
+type uidStream struct {
+	readStats
+	uids      chan string
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newUIDStream() *uidStream {
+	return &uidStream{
+		uids: make(chan string),
+		done: make(chan struct{}),
+	}
+}
+
+// send blocks until uid is read by UID, it returns false if the stream was shutdown first
+func (s *uidStream) send(uid string) bool {
+	select {
+	case <-s.done:
+		return false
+	case s.uids <- uid:
+		s.reads.Add(1)
+		return true
+	}
+}
+
+// sleep waits for delay, it returns false if the stream was shutdown first
+func (s *uidStream) sleep(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-s.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// isShutdown returns true once shutdown has been called
+func (s *uidStream) isShutdown() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops the stream and calls closeSource (once) to release whatever the goroutine is reading from
+func (s *uidStream) shutdown(closeSource func()) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		closeSource()
+	})
+}
+
+func (s *uidStream) UID(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", contextError(ctx)
+	case uid := <-s.uids:
+		return uid, nil
+	case <-s.done:
+		// Same as a halted MFRC522, the reader was shutdown
+		return "", ErrHalted
+	}
+}
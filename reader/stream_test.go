@@ -0,0 +1,286 @@
+package reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+// These tests are only really useful under go test -race
+
+const (
+	readers     = 8
+	hangTimeout = 5 * time.Second
+)
+
+// fakeDevice never sees a card, readUID blocks for the timeout unless the device is halted first
+type fakeDevice struct {
+	sync.Mutex
+	readStats
+	closed    atomic.Bool
+	halted    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{halted: make(chan struct{})}
+}
+
+func (d *fakeDevice) isClosed() bool {
+	return d.closed.Load()
+}
+
+func (d *fakeDevice) readUID(timeout time.Duration) ([]byte, *event.Tag, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-d.halted:
+		return nil, nil, ErrHalted
+	case <-timer.C:
+		return nil, nil, ErrTimeout
+	}
+}
+
+func (d *fakeDevice) reinit() error {
+	return nil
+}
+
+func (d *fakeDevice) stats() *readStats {
+	return &d.readStats
+}
+
+// Close follows the same order as the hardware backends: mark closed, halt the in-progress read then
+// take the lock
+func (d *fakeDevice) Close() {
+	d.closed.Store(true)
+	d.closeOnce.Do(func() { close(d.halted) })
+	d.Lock()
+	defer d.Unlock()
+}
+
+// wait fails the test if wg isn't done before hangTimeout, i.e. a UID call never returned
+func wait(t *testing.T, wg *sync.WaitGroup) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(hangTimeout):
+		t.Fatal("UID calls were still blocked after the reader was closed")
+	}
+}
+
+// expectDone fails unless err is one of the errors UID returns when it's cancelled or closed
+func expectDone(t *testing.T, err error) {
+	t.Helper()
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrHalted) {
+		t.Errorf("UID: unexpected error: %v", err)
+	}
+}
+
+func TestReadUIDCancelAndClose(t *testing.T) {
+	d := newFakeDevice()
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if i%2 == 0 {
+				// Half are cancelled while the other half are still reading when Close runs
+				time.AfterFunc(time.Duration(i)*time.Millisecond, cancel)
+			}
+			_, _, err := readUID(ctx, d)
+			expectDone(t, err)
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	d.Close()
+	wait(t, &wg)
+
+	if _, _, err := readUID(context.Background(), d); !errors.Is(err, ErrHalted) {
+		t.Errorf("readUID after Close: got %v, want %v", err, ErrHalted)
+	}
+}
+
+func TestUIDStreamCancelAndClose(t *testing.T) {
+	s := newUIDStream()
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if i%2 == 0 {
+				time.AfterFunc(time.Duration(i)*time.Millisecond, cancel)
+			}
+			_, err := s.UID(ctx)
+			expectDone(t, err)
+		}()
+	}
+
+	var closed atomic.Int32
+	time.Sleep(5 * time.Millisecond)
+	// Close is safe to call more than once, and from more than one goroutine
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.shutdown(func() { closed.Add(1) })
+		}()
+	}
+	wait(t, &wg)
+
+	if got := closed.Load(); got != 1 {
+		t.Errorf("the source was closed %v times, want 1", got)
+	}
+	if s.send("04A1B2C3") {
+		t.Error("send after shutdown: got true, want false")
+	}
+	if _, err := s.UID(context.Background()); !errors.Is(err, ErrHalted) {
+		t.Errorf("UID after shutdown: got %v, want %v", err, ErrHalted)
+	}
+}
+
+func TestUIDStreamFanOut(t *testing.T) {
+	const uids = 200
+	s := newUIDStream()
+
+	sent := make(chan int)
+	go func() {
+		count := 0
+		for ; count < uids; count++ {
+			if !s.send(fmt.Sprintf("%08X", count)) {
+				break
+			}
+		}
+		sent <- count
+	}()
+
+	var (
+		lock     sync.Mutex
+		received = map[string]int{}
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				// Short deadlines so some calls give up while the sender is handing a UID over
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i+1)*time.Millisecond)
+				uid, err := s.UID(ctx)
+				cancel()
+				switch {
+				case errors.Is(err, ErrTimeout):
+					continue
+				case err != nil:
+					expectDone(t, err)
+					return
+				}
+				lock.Lock()
+				received[uid]++
+				lock.Unlock()
+			}
+		}()
+	}
+
+	if count := <-sent; count != uids {
+		t.Fatalf("sent %v UIDs, want %v", count, uids)
+	}
+	s.shutdown(func() {})
+	wait(t, &wg)
+
+	if len(received) != uids {
+		t.Errorf("received %v distinct UIDs, want %v", len(received), uids)
+	}
+	for uid, count := range received {
+		if count != 1 {
+			t.Errorf("%v was received %v times, want 1", uid, count)
+		}
+	}
+	if reads := s.Stats().Reads; reads != uids {
+		t.Errorf("got %v reads, want %v", reads, uids)
+	}
+}
+
+func TestSimulatedReaderCloseWhileReading(t *testing.T) {
+	// Like stdin or a FIFO the pipe never ends, it's only closed by Close
+	r := &simulatedReader{uidStream: newUIDStream(), source: "test", finished: make(chan struct{})}
+	in, out := io.Pipe()
+	r.closer = in
+	go r.run(in)
+
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				_, err := r.UID(context.Background())
+				if err != nil {
+					expectDone(t, err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < readers; i++ {
+		if _, err := fmt.Fprintf(out, "%08X\n", i); err != nil {
+			t.Fatalf("unable to write to the pipe: %v", err)
+		}
+	}
+	r.Close()
+	wait(t, &wg)
+}
+
+func TestSimulatedReaderCloseStdin(t *testing.T) {
+	in, out, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unable to create a pipe: %v", err)
+	}
+	defer out.Close()
+	defer in.Close()
+	stdin := os.Stdin
+	os.Stdin = in
+	defer func() { os.Stdin = stdin }()
+
+	r, err := NewSimulated(stdinSource)
+	if err != nil {
+		t.Fatalf("NewSimulated: %v", err)
+	}
+	if _, err := fmt.Fprintln(out, "04A1B2C3"); err != nil {
+		t.Fatalf("unable to write to the pipe: %v", err)
+	}
+	if uid, err := r.UID(context.Background()); err != nil || uid != "04A1B2C3" {
+		t.Fatalf("UID: got '%v', %v, want '04A1B2C3'", uid, err)
+	}
+
+	// Nothing else is written, the scanner is blocked reading stdin when Close runs
+	r.Close()
+	select {
+	case <-r.(*simulatedReader).finished:
+	default:
+		t.Error("stdin was still being read after Close")
+	}
+
+	// Only the reader's copy was closed
+	if _, err := fmt.Fprintln(out, "04A1B2C3"); err != nil {
+		t.Errorf("stdin was closed by Close: %v", err)
+	}
+}
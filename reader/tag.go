@@ -0,0 +1,199 @@
+package reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+const (
+	// MIFARE Ultralight and NTAG21x both answer with this ATQA and a SAK of 0
+	ultralightATQA = 0x0044
+	ultralightSAK  = 0x00
+
+	ultralightRead = 0x30
+	// Each read returns 4 pages of 4 bytes
+	ultralightPageSize      = 4
+	ultralightPagesPerRead  = 4
+	ultralightCCPage        = 3
+	ultralightUserPage      = 4
+	ultralightCCMagicNumber = 0xE1
+
+	ndefTLVNull       = 0x00
+	ndefTLVMessage    = 0x03
+	ndefTLVTerminator = 0xFE
+
+	ndefFlagMessageEnd  = 0x40
+	ndefFlagChunk       = 0x20
+	ndefFlagShortRecord = 0x10
+	ndefFlagIDLength    = 0x08
+	ndefTNFMask         = 0x07
+)
+
+var (
+	// The data area size in the capability container (in units of 8 bytes) for the tags we can name
+	ultralightTypes = map[byte]string{
+		0x06: "MIFARE Ultralight",
+		0x12: "NTAG213",
+		0x3E: "NTAG215",
+		0x6D: "NTAG216",
+	}
+	sakTypes = map[byte]string{
+		0x08: "MIFARE Classic 1K",
+		0x09: "MIFARE Mini",
+		0x18: "MIFARE Classic 4K",
+		0x20: "ISO 14443-4",
+	}
+)
+
+// TagReader is implemented by the readers which can read more than the UID from a tag
+type TagReader interface {
+	Reader
+	// ReadTag is the same as UID but also returns what was read from the tag, the tag is nil unless the
+	// reader was configured to read tag data
+	ReadTag(ctx context.Context) (string, *event.Tag, error)
+}
+
+// readTagData fills in tag using readPages, which returns the 16 bytes starting at page, to read the
+// capability container and user memory of an NTAG/MIFARE Ultralight. Other tags are only named.
+func readTagData(tag *event.Tag, readPages func(page byte) ([]byte, error)) error {
+	if tag.ATQA != ultralightATQA || tag.SAK != ultralightSAK {
+		if name, exists := sakTypes[tag.SAK]; exists {
+			tag.Type = name
+		} else {
+			tag.Type = fmt.Sprintf("unknown (ATQA %#04x, SAK %#02x)", tag.ATQA, tag.SAK)
+		}
+		return nil
+	}
+
+	tag.Type = "MIFARE Ultralight/NTAG"
+	data, err := readPages(ultralightCCPage)
+	if err != nil {
+		return fmt.Errorf("unable to read the capability container: %v", err)
+	}
+	if len(data) < ultralightPageSize {
+		return fmt.Errorf("unable to read the capability container: expected %v bytes but received %v", ultralightPageSize, len(data))
+	}
+	cc := data[:ultralightPageSize]
+	if cc[0] != ultralightCCMagicNumber {
+		// Not formatted for NDEF, there's no way to know how much memory there is
+		return nil
+	}
+	if name, exists := ultralightTypes[cc[2]]; exists {
+		tag.Type = name
+	}
+
+	// The first 12 bytes of user memory came back with the capability container
+	size := int(cc[2]) * 8
+	memory := append([]byte{}, data[ultralightPageSize:]...)
+	for page := ultralightUserPage + len(memory)/ultralightPageSize; len(memory) < size; page += ultralightPagesPerRead {
+		data, err := readPages(byte(page))
+		if err != nil {
+			return fmt.Errorf("unable to read page %v: %v", page, err)
+		}
+		memory = append(memory, data...)
+	}
+	if len(memory) > size {
+		memory = memory[:size]
+	}
+	tag.Memory = memory
+
+	records, err := parseNDEF(memory)
+	if err != nil {
+		return err
+	}
+	tag.NDEF = records
+	return nil
+}
+
+// parseNDEF finds the NDEF message TLV in memory and returns its records
+func parseNDEF(memory []byte) ([]event.NDEFRecord, error) {
+	for i := 0; i < len(memory); {
+		tlvType := memory[i]
+		i++
+		switch tlvType {
+		case ndefTLVNull:
+			continue
+		case ndefTLVTerminator:
+			return nil, nil
+		}
+
+		if i >= len(memory) {
+			break
+		}
+		length := int(memory[i])
+		i++
+		if length == 0xFF {
+			if i+2 > len(memory) {
+				break
+			}
+			length = int(memory[i])<<8 | int(memory[i+1])
+			i += 2
+		}
+		if i+length > len(memory) {
+			return nil, fmt.Errorf("ndef: TLV %#02x is %v bytes but only %v remain", tlvType, length, len(memory)-i)
+		}
+		if tlvType == ndefTLVMessage {
+			return parseNDEFMessage(memory[i : i+length])
+		}
+		i += length
+	}
+	return nil, errors.New("ndef: truncated TLV")
+}
+
+func parseNDEFMessage(message []byte) ([]event.NDEFRecord, error) {
+	var records []event.NDEFRecord
+	for i := 0; i < len(message); {
+		header := message[i]
+		i++
+		if header&ndefFlagChunk != 0 {
+			return nil, errors.New("ndef: chunked records are not supported")
+		}
+
+		var typeLength, idLength, payloadLength int
+		if i >= len(message) {
+			return nil, errors.New("ndef: truncated record header")
+		}
+		typeLength = int(message[i])
+		i++
+		if header&ndefFlagShortRecord != 0 {
+			if i+1 > len(message) {
+				return nil, errors.New("ndef: truncated record header")
+			}
+			payloadLength = int(message[i])
+			i++
+		} else {
+			if i+4 > len(message) {
+				return nil, errors.New("ndef: truncated record header")
+			}
+			payloadLength = int(message[i])<<24 | int(message[i+1])<<16 | int(message[i+2])<<8 | int(message[i+3])
+			i += 4
+		}
+		if header&ndefFlagIDLength != 0 {
+			if i+1 > len(message) {
+				return nil, errors.New("ndef: truncated record header")
+			}
+			idLength = int(message[i])
+			i++
+		}
+
+		if payloadLength < 0 || i+typeLength+idLength+payloadLength > len(message) {
+			return nil, errors.New("ndef: truncated record")
+		}
+		record := event.NDEFRecord{TNF: header & ndefTNFMask}
+		record.Type = string(message[i : i+typeLength])
+		i += typeLength
+		record.ID = string(message[i : i+idLength])
+		i += idLength
+		record.Payload = append([]byte{}, message[i:i+payloadLength]...)
+		i += payloadLength
+		records = append(records, record)
+
+		if header&ndefFlagMessageEnd != 0 {
+			break
+		}
+	}
+	return records, nil
+}
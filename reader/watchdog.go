@@ -0,0 +1,212 @@
+package reader
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+type HealthState int
+
+const (
+	HEALTHY HealthState = iota
+	RECOVERING
+	FAILED
+)
+
+var healthStateToString = map[HealthState]string{
+	HEALTHY:    "HEALTHY",
+	RECOVERING: "RECOVERING",
+	FAILED:     "FAILED",
+}
+
+func (hs HealthState) String() string {
+	return healthStateToString[hs]
+}
+
+// Health is the state of a reader as last seen by its Watchdog
+type Health struct {
+	State HealthState
+	// When the last check was made, zero until the first check
+	LastCheck time.Time
+	// Why the last recovery was needed, or why it failed, "" if the reader has always been healthy
+	LastError  string
+	Recoveries uint64
+}
+
+// supervised is implemented by the hardware backends which the Watchdog can check and recover
+type supervised interface {
+	// selfTest checks the hardware is responding
+	selfTest() error
+	// recover power cycles and/or reopens the hardware
+	recover() error
+}
+
+// Watchdog wraps a Reader and periodically checks it's still working. A reader is recovered when its
+// self-test fails, when it reports maxErrors or more errors (IRQ errors and retries) between two checks
+// or when nothing has been read for maxIdle and it's reported errors since the last read. A reader which
+// is idle without any errors (e.g. overnight) is left alone. Readers which can't be checked (e.g. evdev)
+// are always HEALTHY.
+type Watchdog struct {
+	Reader
+	id        string
+	interval  time.Duration
+	maxErrors uint64
+	maxIdle   time.Duration
+	health    Health
+	lastStats Stats
+	lastRead  time.Time
+	// The errors reported since lastRead, spread across any number of checks
+	errorsSinceRead uint64
+	stop            chan struct{}
+	done            chan struct{}
+	lock            sync.RWMutex
+}
+
+// NewWatchdog wraps reader, id is only used for logging. An interval of 0 disables the checks as does
+// a maxIdle of 0 for the idle check.
+func NewWatchdog(id string, reader Reader, interval time.Duration, maxErrors int, maxIdle time.Duration) (*Watchdog, error) {
+	log.Tracef("Creating new Watchdog for '%v' with interval=%v, maxErrors=%v, maxIdle=%v", id, interval, maxErrors, maxIdle)
+	if interval < 0 {
+		return nil, fmt.Errorf("invalid value for reader-watchdog-interval: '%v', must be 0 (disabled) or greater", interval)
+	}
+	if maxErrors < 1 {
+		return nil, fmt.Errorf("invalid value for reader-watchdog-max-errors: '%v', must be 1 or greater", maxErrors)
+	}
+	if maxIdle < 0 {
+		return nil, fmt.Errorf("invalid value for reader-watchdog-max-idle: '%v', must be 0 (disabled) or greater", maxIdle)
+	}
+
+	w := &Watchdog{
+		Reader:    reader,
+		id:        id,
+		interval:  interval,
+		maxErrors: uint64(maxErrors),
+		maxIdle:   maxIdle,
+		lastStats: reader.Stats(),
+		lastRead:  time.Now(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	if _, ok := reader.(supervised); ok && interval > 0 {
+		go w.run()
+	} else {
+		close(w.done)
+	}
+	return w, nil
+}
+
+// ReadTag passes through to the wrapped reader if it's a TagReader, otherwise it's the same as UID
+func (w *Watchdog) ReadTag(ctx context.Context) (string, *event.Tag, error) {
+	if tagReader, ok := w.Reader.(TagReader); ok {
+		return tagReader.ReadTag(ctx)
+	}
+	uid, err := w.Reader.UID(ctx)
+	return uid, nil, err
+}
+
+func (w *Watchdog) Health() Health {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.health
+}
+
+// Close stops the watchdog before closing the wrapped reader so a recovery can't reopen it
+func (w *Watchdog) Close() {
+	log.Tracef("Closing Watchdog for '%v'", w.id)
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	<-w.done
+	w.Reader.Close()
+	log.Trace("Watchdog closed")
+}
+
+func (w *Watchdog) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check runs the self-test, looks at the stats since the last check and recovers the reader if needed
+func (w *Watchdog) check() {
+	device := w.Reader.(supervised)
+	now := time.Now()
+	stats := w.Reader.Stats()
+	failures := (stats.IRQErrors + stats.Retries) - (w.lastStats.IRQErrors + w.lastStats.Retries)
+	if stats.Reads != w.lastStats.Reads {
+		w.lastRead = now
+		w.errorsSinceRead = 0
+	} else {
+		w.errorsSinceRead += failures
+	}
+	w.lastStats = stats
+
+	var reason string
+	if err := device.selfTest(); err != nil {
+		reason = fmt.Sprintf("self-test failed: %v", err)
+	} else if failures >= w.maxErrors {
+		reason = fmt.Sprintf("%v errors since the last check", failures)
+	} else if w.maxIdle > 0 && now.Sub(w.lastRead) >= w.maxIdle && w.errorsSinceRead > 0 {
+		reason = fmt.Sprintf("nothing read for %v with %v errors since the last read", now.Sub(w.lastRead).Round(time.Second), w.errorsSinceRead)
+	}
+
+	if reason == "" {
+		w.setHealth(func(h *Health) {
+			if h.State != HEALTHY {
+				log.Infof("Reader '%v' is healthy again", w.id)
+			}
+			h.State = HEALTHY
+			h.LastCheck = now
+		})
+		return
+	}
+
+	log.Warnf("Reader '%v' needs to be recovered: %v", w.id, reason)
+	w.setHealth(func(h *Health) {
+		h.State = RECOVERING
+		h.LastCheck = now
+		h.LastError = reason
+	})
+
+	if err := device.recover(); err != nil {
+		log.Errorf("Unable to recover reader '%v', will try again in %v: %v", w.id, w.interval, err)
+		w.setHealth(func(h *Health) {
+			h.State = FAILED
+			h.LastError = fmt.Sprintf("%v, recovery failed: %v", reason, err)
+		})
+		return
+	}
+
+	// Don't count what happened before the recovery against the next check
+	w.lastStats = w.Reader.Stats()
+	w.lastRead = time.Now()
+	w.errorsSinceRead = 0
+	w.setHealth(func(h *Health) {
+		h.State = HEALTHY
+		h.Recoveries++
+	})
+	log.Infof("Reader '%v' recovered", w.id)
+}
+
+func (w *Watchdog) setHealth(update func(*Health)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	update(&w.health)
+}
@@ -0,0 +1,14 @@
+package rfidsecuritysvc
+
+import (
+	"context"
+	"net/http"
+)
+
+const (
+	auditUrl = "audit"
+)
+
+func (s *service) Audit(ctx context.Context, auditEvent AuditEvent) error {
+	return s.Post(ctx, auditUrl, s.config.Timeout, auditEvent, http.StatusCreated, nil)
+}
@@ -1,6 +1,8 @@
 package rfidsecuritysvc
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"net/url"
 
@@ -11,14 +13,46 @@ import (
 
 const (
 	permissionUrlFormat = "authorized/%v/%v"
+	// Keeps the request well inside the URL limits of the service and any proxies in front of it
+	maxTagQueryLength = 1024
 )
 
 func (s *service) Authorized(event event.Event, permission string) (*MediaConfig, error) {
+	return s.AuthorizedContext(context.Background(), event, permission)
+}
+
+func (s *service) AuthorizedContext(ctx context.Context, event event.Event, permission string) (*MediaConfig, error) {
 	var mediaConfig MediaConfig
 	url := fmt.Sprintf(permissionUrlFormat, url.PathEscape(event.UID()), url.PathEscape(permission))
-	if err := s.Get(url, 200, &mediaConfig); err != nil {
+	if s.config.SendTagData {
+		if query := tagQuery(event.Tag()); query != "" {
+			url += "?" + query
+		}
+	}
+	if err := s.Get(ctx, url, s.config.Timeout, 200, &mediaConfig); err != nil {
 		log.Debugf("Error calling '%v': %v", url, err)
 		return nil, err
 	}
 	return &mediaConfig, nil
 }
+
+// tagQuery passes along what was read from the tag so rfid-security-svc can check the tag type and
+// verify any payload (e.g. a signature) written to it. Each NDEF payload is base64url encoded. If the
+// records would make the query longer than maxTagQueryLength none of them are sent, only some of them
+// could verify differently to all of them.
+func tagQuery(tag *event.Tag) string {
+	if tag == nil {
+		return ""
+	}
+	query := url.Values{}
+	query.Set("tag_type", tag.Type)
+	typeOnly := query.Encode()
+	for _, record := range tag.NDEF {
+		query.Add("ndef", base64.RawURLEncoding.EncodeToString(record.Payload))
+	}
+	if encoded := query.Encode(); len(encoded) <= maxTagQueryLength {
+		return encoded
+	}
+	log.Warnf("The NDEF records of the %v tag are too large to send (%v records, more than %v bytes), only sending the tag type", tag.Type, len(tag.NDEF), maxTagQueryLength)
+	return typeOnly
+}
@@ -0,0 +1,100 @@
+package rfidsecuritysvc
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+// newTestService creates a service calling url, config only needs the settings under test
+func newTestService(t *testing.T, url string, config Config) *service {
+	t.Helper()
+	config.URL = url
+	config.SSLVerify = "false"
+	if config.Timeout == 0 {
+		config.Timeout = time.Second
+	}
+	if config.SyncTimeout == 0 {
+		config.SyncTimeout = time.Second
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s.(*service)
+}
+
+func TestTagQuery(t *testing.T) {
+	small := event.NDEFRecord{Payload: []byte("signed")}
+	large := event.NDEFRecord{Payload: bytes.Repeat([]byte{0xA5}, maxTagQueryLength)}
+
+	tests := []struct {
+		name string
+		tag  *event.Tag
+		want url.Values
+	}{
+		{
+			name: "no tag",
+		},
+		{
+			name: "type only",
+			tag:  &event.Tag{Type: "NTAG215"},
+			want: url.Values{"tag_type": {"NTAG215"}},
+		},
+		{
+			name: "records",
+			tag:  &event.Tag{Type: "NTAG215", NDEF: []event.NDEFRecord{small, small}},
+			want: url.Values{"tag_type": {"NTAG215"}, "ndef": {"c2lnbmVk", "c2lnbmVk"}},
+		},
+		{
+			name: "records too large",
+			tag:  &event.Tag{Type: "NTAG215", NDEF: []event.NDEFRecord{small, large}},
+			want: url.Values{"tag_type": {"NTAG215"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := tagQuery(test.tag)
+			if len(query) > maxTagQueryLength {
+				t.Errorf("got a query of %v bytes, want at most %v", len(query), maxTagQueryLength)
+			}
+			if test.want == nil {
+				if query != "" {
+					t.Errorf("got '%v', want ''", query)
+				}
+				return
+			}
+			if want := test.want.Encode(); query != want {
+				t.Errorf("got '%v', want '%v'", query, want)
+			}
+		})
+	}
+}
+
+func TestAuthorizedSendTagData(t *testing.T) {
+	for _, sendTagData := range []bool{false, true} {
+		var query url.Values
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			query = req.URL.Query()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		}))
+		defer server.Close()
+
+		s := newTestService(t, server.URL, Config{SendTagData: sendTagData})
+		e := event.NewEvent("default", "04A1B2C3", event.UNKNOWN)
+		e.SetTag(&event.Tag{Type: "NTAG215", NDEF: []event.NDEFRecord{{Payload: []byte("signed")}}})
+		if _, err := s.Authorized(e, "open door"); err != nil {
+			t.Fatalf("Authorized: %v", err)
+		}
+		if sent := query.Has("tag_type"); sent != sendTagData {
+			t.Errorf("with SendTagData %v the tag was sent: %v", sendTagData, sent)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package rfidsecuritysvc
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bcurnow/magicband-reader/metrics"
+)
+
+// ErrCircuitOpen is returned without calling the service while the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open, not calling rfid-security-svc")
+
+type BreakerState int
+
+const (
+	// Calls are made as normal
+	CLOSED BreakerState = iota
+	// The cooldown has passed, a single trial call is allowed through to see if the service has recovered
+	HALF_OPEN
+	// The service has failed too many times in a row, calls fail straight away until the cooldown has passed
+	OPEN
+)
+
+var breakerStateToString = map[BreakerState]string{
+	CLOSED:    "CLOSED",
+	HALF_OPEN: "HALF_OPEN",
+	OPEN:      "OPEN",
+}
+
+func (s BreakerState) String() string {
+	return breakerStateToString[s]
+}
+
+// BreakerStatus is the state of the circuit breaker in front of the service
+type BreakerStatus struct {
+	State BreakerState
+	// The number of failed calls in a row
+	Failures int
+	// When the breaker last opened, zero if it never has
+	OpenedAt time.Time
+}
+
+// breaker is a circuit breaker which opens after threshold failed calls in a row, a threshold of 0 disables it
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	status    BreakerStatus
+	// True while the HALF_OPEN trial call is in progress
+	trial bool
+	lock  sync.Mutex
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	metrics.UpstreamBreakerState.Set(float64(CLOSED))
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns ErrCircuitOpen if a call can't be made right now
+func (b *breaker) allow() error {
+	if b.threshold == 0 {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.status.State {
+	case OPEN:
+		if time.Since(b.status.OpenedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		log.Infof("Circuit breaker cooldown of %v has passed, trying rfid-security-svc again", b.cooldown)
+		b.setState(HALF_OPEN)
+		b.trial = true
+	case HALF_OPEN:
+		if b.trial {
+			// Only the trial call is let through
+			return ErrCircuitOpen
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of a call which allow let through
+func (b *breaker) record(failed bool) {
+	if b.threshold == 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.trial = false
+	if !failed {
+		if b.status.State != CLOSED {
+			log.Info("rfid-security-svc has recovered, closing the circuit breaker")
+		}
+		b.status.Failures = 0
+		b.setState(CLOSED)
+		return
+	}
+
+	b.status.Failures++
+	if b.status.State == HALF_OPEN || b.status.Failures >= b.threshold {
+		if b.status.State != OPEN {
+			log.Warnf("rfid-security-svc failed %v times in a row, opening the circuit breaker for %v", b.status.Failures, b.cooldown)
+		}
+		b.status.OpenedAt = time.Now()
+		b.setState(OPEN)
+	}
+}
+
+// release gives up a call which allow let through without recording an outcome, e.g. the caller cancelled it
+func (b *breaker) release() {
+	if b.threshold == 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.trial = false
+}
+
+func (b *breaker) current() BreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.status
+}
+
+func (b *breaker) setState(state BreakerState) {
+	b.status.State = state
+	metrics.UpstreamBreakerState.Set(float64(state))
+}
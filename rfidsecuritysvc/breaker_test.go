@@ -0,0 +1,95 @@
+package rfidsecuritysvc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const testCooldown = 20 * time.Millisecond
+
+// expectState fails the test unless b is in state with failures failed calls in a row
+func expectState(t *testing.T, b *breaker, state BreakerState, failures int) {
+	t.Helper()
+	if status := b.current(); status.State != state || status.Failures != failures {
+		t.Fatalf("got %v with %v failures, want %v with %v", status.State, status.Failures, state, failures)
+	}
+}
+
+func expectAllowed(t *testing.T, b *breaker, allowed bool) {
+	t.Helper()
+	err := b.allow()
+	switch {
+	case allowed && err != nil:
+		t.Fatalf("allow: unexpected error: %v", err)
+	case !allowed && !errors.Is(err, ErrCircuitOpen):
+		t.Fatalf("allow: got %v, want %v", err, ErrCircuitOpen)
+	}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	b := newBreaker(2, testCooldown)
+	expectState(t, b, CLOSED, 0)
+
+	expectAllowed(t, b, true)
+	b.record(true)
+	expectState(t, b, CLOSED, 1)
+
+	// A success resets the count, the failures have to be in a row
+	expectAllowed(t, b, true)
+	b.record(false)
+	expectState(t, b, CLOSED, 0)
+
+	expectAllowed(t, b, true)
+	b.record(true)
+	expectAllowed(t, b, true)
+	b.record(true)
+	expectState(t, b, OPEN, 2)
+	if b.current().OpenedAt.IsZero() {
+		t.Error("OpenedAt wasn't set when the breaker opened")
+	}
+	expectAllowed(t, b, false)
+
+	// Once the cooldown has passed a single trial call is let through
+	time.Sleep(testCooldown + 5*time.Millisecond)
+	expectAllowed(t, b, true)
+	expectState(t, b, HALF_OPEN, 2)
+	expectAllowed(t, b, false)
+
+	// A failed trial opens it again straight away
+	b.record(true)
+	expectState(t, b, OPEN, 3)
+	expectAllowed(t, b, false)
+
+	// A successful trial closes it
+	time.Sleep(testCooldown + 5*time.Millisecond)
+	expectAllowed(t, b, true)
+	b.record(false)
+	expectState(t, b, CLOSED, 0)
+	expectAllowed(t, b, true)
+	expectAllowed(t, b, true)
+}
+
+func TestBreakerRelease(t *testing.T) {
+	b := newBreaker(1, testCooldown)
+	expectAllowed(t, b, true)
+	b.record(true)
+	expectState(t, b, OPEN, 1)
+
+	time.Sleep(testCooldown + 5*time.Millisecond)
+	expectAllowed(t, b, true)
+	// The trial was cancelled, it says nothing about the service so another trial is allowed
+	b.release()
+	expectState(t, b, HALF_OPEN, 1)
+	expectAllowed(t, b, true)
+	expectAllowed(t, b, false)
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newBreaker(0, testCooldown)
+	for i := 0; i < 10; i++ {
+		expectAllowed(t, b, true)
+		b.record(true)
+	}
+	expectState(t, b, CLOSED, 0)
+}
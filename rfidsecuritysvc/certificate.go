@@ -0,0 +1,84 @@
+package rfidsecuritysvc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certificateReloader presents the client certificate for mTLS, reloading it from disk whenever the
+// certificate or key file changes so a rotated certificate is picked up without restarting
+type certificateReloader struct {
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+	// The modification times of the files the certificate was loaded from
+	certModTime time.Time
+	keyModTime  time.Time
+	lock        sync.Mutex
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, fmt.Errorf("invalid value for api-tls-client-cert/api-tls-client-key: %v", err)
+	}
+	return r, nil
+}
+
+// GetClientCertificate is called for every TLS handshake, it checks if the files have changed first. If the
+// new certificate can't be loaded (e.g. only the certificate has been replaced so far) the last one which
+// could be is used.
+func (r *certificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.changed() {
+		if err := r.reload(); err != nil {
+			log.Errorf("Unable to reload the rfid-security-svc client certificate, still using the previous one: %v", err)
+		} else {
+			log.Infof("Reloaded the rfid-security-svc client certificate from %v", r.certFile)
+		}
+	}
+	return r.certificate, nil
+}
+
+func (r *certificateReloader) changed() bool {
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		log.Errorf("Unable to check the rfid-security-svc client certificate for changes: %v", err)
+		return false
+	}
+	return !certModTime.Equal(r.certModTime) || !keyModTime.Equal(r.keyModTime)
+}
+
+func (r *certificateReloader) reload() error {
+	// Read before loading so a file which changes in between is loaded again next time
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.certificate = &certificate
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+	return nil
+}
+
+func (r *certificateReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
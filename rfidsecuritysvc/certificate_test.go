@@ -0,0 +1,151 @@
+package rfidsecuritysvc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert []byte
+	key  []byte
+}
+
+// newTestCertificate returns a PEM encoded self-signed certificate and key for commonName
+func newTestCertificate(t *testing.T, commonName string) testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate a key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create a certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal the key: %v", err)
+	}
+	return testCertificate{
+		cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeFile writes data to file and sets its modification time, the files in a test are written faster
+// than some file systems record
+func writeFile(t *testing.T, file string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("unable to write %v: %v", file, err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatalf("unable to set the modification time of %v: %v", file, err)
+	}
+}
+
+// presented returns the common name of the certificate r presents
+func presented(t *testing.T, r *certificateReloader) string {
+	t.Helper()
+	certificate, err := r.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetClientCertificate: %v", err)
+	}
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("unable to parse the certificate: %v", err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := path.Join(dir, "client.pem")
+	keyFile := path.Join(dir, "client-key.pem")
+	original := newTestCertificate(t, "original")
+	rotated := newTestCertificate(t, "rotated")
+	modTime := time.Now().Add(-time.Hour)
+
+	writeFile(t, certFile, original.cert, modTime)
+	writeFile(t, keyFile, original.key, modTime)
+	r, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertificateReloader: %v", err)
+	}
+	if name := presented(t, r); name != "original" {
+		t.Errorf("presented '%v', want 'original'", name)
+	}
+
+	// Half way through a rotation the certificate doesn't match the key, the previous one is still used
+	modTime = modTime.Add(time.Minute)
+	writeFile(t, certFile, rotated.cert, modTime)
+	if name := presented(t, r); name != "original" {
+		t.Errorf("presented '%v' half way through the rotation, want 'original'", name)
+	}
+
+	writeFile(t, keyFile, rotated.key, modTime)
+	if name := presented(t, r); name != "rotated" {
+		t.Errorf("presented '%v' after the rotation, want 'rotated'", name)
+	}
+
+	// A file which has gone missing keeps the current certificate
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatalf("unable to remove %v: %v", keyFile, err)
+	}
+	if name := presented(t, r); name != "rotated" {
+		t.Errorf("presented '%v' without a key file, want 'rotated'", name)
+	}
+}
+
+func TestCertificateReloaderUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	certFile := path.Join(dir, "client.pem")
+	keyFile := path.Join(dir, "client-key.pem")
+	original := newTestCertificate(t, "original")
+	modTime := time.Now().Add(-time.Hour)
+	writeFile(t, certFile, original.cert, modTime)
+	writeFile(t, keyFile, original.key, modTime)
+	r, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertificateReloader: %v", err)
+	}
+
+	// The files are only read again once their modification time changes
+	rotated := newTestCertificate(t, "rotated")
+	writeFile(t, certFile, rotated.cert, modTime)
+	writeFile(t, keyFile, rotated.key, modTime)
+	if name := presented(t, r); name != "original" {
+		t.Errorf("presented '%v', want 'original'", name)
+	}
+}
+
+func TestNewCertificateReloaderInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile := path.Join(dir, "client.pem")
+	keyFile := path.Join(dir, "client-key.pem")
+	writeFile(t, certFile, newTestCertificate(t, "client").cert, time.Now())
+	writeFile(t, keyFile, newTestCertificate(t, "other").key, time.Now())
+
+	if _, err := newCertificateReloader(certFile, keyFile); err == nil || !strings.Contains(err.Error(), "invalid value for api-tls-client-cert/api-tls-client-key") {
+		t.Errorf("got error %v for a certificate which doesn't match its key", err)
+	}
+	if _, err := newCertificateReloader(certFile, path.Join(dir, "missing.pem")); err == nil {
+		t.Error("got no error for a missing key file")
+	}
+}
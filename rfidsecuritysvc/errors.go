@@ -0,0 +1,62 @@
+package rfidsecuritysvc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+// StatusError is returned when the service responds with a status code other than the one expected
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Expected   int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bad response from '%v', expected %v but received %v", e.URL, e.Expected, e.StatusCode)
+}
+
+// RequestError is returned when the service didn't respond (e.g. it's unreachable, a TLS failure or a timeout)
+type RequestError struct {
+	URL string
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	// The errors from http.Client already include the URL
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout returns true if the service didn't respond in time
+func (e *RequestError) Timeout() bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(e.Err, &timeout) && timeout.Timeout()
+}
+
+// ReasonFor returns why an Authorized call which returned err didn't authorize the band
+func ReasonFor(err error) event.Reason {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusForbidden:
+			return event.DENIED
+		case http.StatusNotFound:
+			return event.UNKNOWN_MEDIA
+		}
+		// Anything else (e.g. a 401 for a bad API key or a 5xx) means the band couldn't be checked
+		return event.SERVICE_ERROR
+	}
+
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) && requestErr.Timeout() {
+		return event.TIMEOUT
+	}
+	return event.SERVICE_ERROR
+}
@@ -1,78 +1,246 @@
 package rfidsecuritysvc
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/bcurnow/magicband-reader/event"
+	"github.com/bcurnow/magicband-reader/metrics"
+)
+
+const (
+	// The longest delay between retries, however many there are
+	maxRetryBackoff = 5 * time.Second
 )
 
 type Service interface {
 	Authorized(event event.Event, permission string) (*MediaConfig, error)
+	// AuthorizedContext is Authorized but cancelling ctx aborts the request
+	AuthorizedContext(ctx context.Context, event event.Event, permission string) (*MediaConfig, error)
 	Sounds() SoundService
+	// Audit records the outcome of a read with the service
+	Audit(ctx context.Context, auditEvent AuditEvent) error
+	// LastCall returns the outcome of the most recent request to the service
+	LastCall() CallStatus
+	// Breaker returns the state of the circuit breaker in front of the service
+	Breaker() BreakerStatus
+}
+
+// CallStatus describes a request to the service, a request which got a response is successful even if
+// the status code wasn't the one expected as long as it's not a fault (e.g. a 403 for an unauthorized band
+// is successful, a 401 or a 5xx isn't)
+type CallStatus struct {
+	// Zero if no requests have been made
+	Time  time.Time
+	Error error
+}
+
+// Config holds the settings of the client
+type Config struct {
+	APIKey string
+	// 'false' or a CA certificate file to validate the service against
+	SSLVerify string
+	// The certificate and key to authenticate with (mTLS), they're reloaded when the files change
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+	// If set, used instead of the host name in URL to validate the certificate of the service
+	TLSServerName string
+	URL           string
+	// How long a single authorization request can take
+	Timeout time.Duration
+	// How long a single request while syncing the sounds can take, they're much larger
+	SyncTimeout time.Duration
+	// How many times a request which failed because of a fault is retried
+	Retries int
+	// The delay before the first retry, it doubles for each retry after that (plus jitter)
+	RetryBackoff time.Duration
+	// If true, the tag read along with the UID is sent with the authorization request, the service must
+	// support the tag_type and ndef query parameters
+	SendTagData bool
+	// The number of failed calls in a row which open the circuit breaker, 0 disables it
+	BreakerThreshold int
+	// How long the circuit breaker stays open before the service is tried again
+	BreakerCooldown time.Duration
 }
 
 type service struct {
-	apiUrl *url.URL
-	client *http.Client
+	config   Config
+	apiUrl   *url.URL
+	client   *http.Client
+	breaker  *breaker
+	lastCall atomic.Pointer[CallStatus]
 }
 
-func New(apiKey string, apiSSLVerify string, apiUrl string) (Service, error) {
+func New(config Config) (Service, error) {
 	log.Trace("Creating new rfidsecuritysvc")
 
-	url, err := url.Parse(ensureEndsWith(apiUrl, "/"))
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	url, err := url.Parse(ensureEndsWith(config.URL, "/"))
 	if err != nil {
 		return nil, err
 	}
 
-	transport, err := createTransport(apiSSLVerify, apiKey)
+	transport, err := createTransport(config)
 	if err != nil {
 		return nil, err
 	}
 
+	// Each request sets its own timeout
 	client := &http.Client{
-		Timeout:   60 * time.Second,
 		Transport: transport,
 	}
 
 	s := &service{
-		apiUrl: url,
-		client: client,
+		config:  config,
+		apiUrl:  url,
+		client:  client,
+		breaker: newBreaker(config.BreakerThreshold, config.BreakerCooldown),
 	}
 	return s, nil
 }
 
-func (s *service) Get(urlString string, requiredStatusCode int, jsonStruct interface{}) error {
+func validateConfig(config Config) error {
+	if config.Timeout <= 0 {
+		return fmt.Errorf("invalid value for api-timeout: '%v', must be greater than 0", config.Timeout)
+	}
+	if config.SyncTimeout <= 0 {
+		return fmt.Errorf("invalid value for api-sync-timeout: '%v', must be greater than 0", config.SyncTimeout)
+	}
+	if config.Retries < 0 {
+		return fmt.Errorf("invalid value for api-retries: '%v', must not be negative", config.Retries)
+	}
+	if config.RetryBackoff < 0 {
+		return fmt.Errorf("invalid value for api-retry-backoff: '%v', must not be negative", config.RetryBackoff)
+	}
+	if config.BreakerThreshold < 0 {
+		return fmt.Errorf("invalid value for api-breaker-threshold: '%v', must not be negative", config.BreakerThreshold)
+	}
+	return nil
+}
+
+// Get calls the service, retrying if it fails because of a fault. Nothing is called while the circuit
+// breaker is open. Cancelling ctx aborts the request along with any retries.
+func (s *service) Get(ctx context.Context, urlString string, timeout time.Duration, requiredStatusCode int, jsonStruct interface{}) error {
+	return s.call(ctx, http.MethodGet, urlString, timeout, nil, s.config.Retries, requiredStatusCode, jsonStruct)
+}
+
+// Post sends body to the service as JSON. It's only attempted once, a POST whose response was lost may
+// still have been applied so retrying is left to the caller.
+func (s *service) Post(ctx context.Context, urlString string, timeout time.Duration, body interface{}, requiredStatusCode int, jsonStruct interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return s.call(ctx, http.MethodPost, urlString, timeout, data, 0, requiredStatusCode, jsonStruct)
+}
+
+// call makes the request, retrying it up to retries times if it fails because of a fault
+func (s *service) call(ctx context.Context, method string, urlString string, timeout time.Duration, body []byte, retries int, requiredStatusCode int, jsonStruct interface{}) error {
+	if err := s.breaker.allow(); err != nil {
+		return err
+	}
+
+	endpoint := strings.SplitN(urlString, "/", 2)[0]
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = s.request(ctx, method, urlString, endpoint, timeout, body, requiredStatusCode, jsonStruct)
+		if err == nil || ctx.Err() != nil || attempt >= retries || !retryable(err) {
+			break
+		}
+		delay := backoff(s.config.RetryBackoff, attempt)
+		log.Debugf("%v: '%v' failed, retrying in %v: %v", method, urlString, delay, err)
+		metrics.UpstreamRetries.WithLabelValues(endpoint).Inc()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	if ctx.Err() != nil {
+		// The caller gave up (e.g. we're shutting down), it says nothing about the health of the service
+		s.breaker.release()
+		return err
+	}
+	s.breaker.record(err != nil && ReasonFor(err).IsFault())
+	return err
+}
+
+func (s *service) request(ctx context.Context, method string, urlString string, endpoint string, timeout time.Duration, body []byte, requiredStatusCode int, jsonStruct interface{}) error {
 	url, err := s.apiUrl.Parse(urlString)
 	if err != nil {
 		return err
 	}
 
-	response, err := s.client.Get(url.String())
+	requestCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(requestCtx, method, url.String(), bodyReader)
 	if err != nil {
 		return err
 	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	start := time.Now()
+	response, err := s.client.Do(request)
+	if err != nil {
+		metrics.UpstreamDuration.WithLabelValues(endpoint, "error").Observe(time.Since(start).Seconds())
+		err = &RequestError{URL: url.String(), Err: err}
+		if ctx.Err() != nil {
+			// Cancelled by the caller rather than a failure of the service
+			return err
+		}
+		metrics.UpstreamErrors.WithLabelValues(endpoint).Inc()
+		s.lastCall.Store(&CallStatus{Time: start, Error: err})
+		return err
+	}
+	metrics.UpstreamDuration.WithLabelValues(endpoint, strconv.Itoa(response.StatusCode)).Observe(time.Since(start).Seconds())
+	var statusErr *StatusError
+	if response.StatusCode != requiredStatusCode {
+		statusErr = &StatusError{URL: url.String(), StatusCode: response.StatusCode, Expected: requiredStatusCode}
+	}
+	if statusErr != nil && ReasonFor(statusErr).IsFault() {
+		s.lastCall.Store(&CallStatus{Time: start, Error: statusErr})
+	} else {
+		s.lastCall.Store(&CallStatus{Time: start})
+	}
 	defer func() {
 		if err := response.Body.Close(); err != nil {
-			log.Warnf("Get: failed to close response body: %v", err)
+			log.Warnf("%v: failed to close response body: %v", method, err)
 		}
 	}()
 
-	if response.StatusCode != requiredStatusCode {
-		return fmt.Errorf("bad response from '%v', expected %v but received %v", url, requiredStatusCode, response.StatusCode)
+	if statusErr != nil {
+		metrics.UpstreamErrors.WithLabelValues(endpoint).Inc()
+		return statusErr
 	}
 
 	if jsonStruct != nil {
 		body, err := io.ReadAll(response.Body)
 		if err != nil {
-			return err
+			// e.g. the timeout expired while the body was being read
+			return &RequestError{URL: url.String(), Err: err}
 		}
 		if err := json.Unmarshal(body, jsonStruct); err != nil {
 			return err
@@ -81,6 +249,43 @@ func (s *service) Get(urlString string, requiredStatusCode int, jsonStruct inter
 	return nil
 }
 
+// Breaker returns the state of the circuit breaker in front of the service
+func (s *service) Breaker() BreakerStatus {
+	return s.breaker.current()
+}
+
+// retryable returns true if err is a fault which might not happen again, e.g. there's no point retrying a
+// 401 or a 403
+func retryable(err error) bool {
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		return true
+	}
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= http.StatusInternalServerError)
+}
+
+// backoff returns the delay before retry number attempt (from 0), it doubles each time and is randomized
+// between half and all of that so the readers don't all retry at once
+func backoff(base time.Duration, attempt int) time.Duration {
+	if base == 0 {
+		return 0
+	}
+	delay := base << attempt
+	if delay <= 0 || delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+func (s *service) LastCall() CallStatus {
+	if lastCall := s.lastCall.Load(); lastCall != nil {
+		return *lastCall
+	}
+	return CallStatus{}
+}
+
 func ensureEndsWith(str string, suffix string) string {
 	if strings.HasSuffix(str, suffix) {
 		return str
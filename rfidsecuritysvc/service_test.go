@@ -0,0 +1,161 @@
+package rfidsecuritysvc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	const base = 100 * time.Millisecond
+	for attempt := 0; attempt < 10; attempt++ {
+		want := base << attempt
+		if want > maxRetryBackoff {
+			want = maxRetryBackoff
+		}
+		// Jittered, so check the bounds over a few tries
+		for i := 0; i < 100; i++ {
+			if delay := backoff(base, attempt); delay < want/2 || delay > want {
+				t.Fatalf("backoff(%v, %v) = %v, want between %v and %v", base, attempt, delay, want/2, want)
+			}
+		}
+	}
+
+	if delay := backoff(0, 3); delay != 0 {
+		t.Errorf("backoff(0, 3) = %v, want 0", delay)
+	}
+	// The shift overflows
+	if delay := backoff(base, 100); delay < maxRetryBackoff/2 || delay > maxRetryBackoff {
+		t.Errorf("backoff(%v, 100) = %v, want between %v and %v", base, delay, maxRetryBackoff/2, maxRetryBackoff)
+	}
+}
+
+// statusServer answers each request with the next of statuses, repeating the last one once they run out
+func statusServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		i := int(requests.Add(1)) - 1
+		if i >= len(statuses) {
+			i = len(statuses) - 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statuses[i])
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestGetRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int32
+		wantStatus   int
+	}{
+		{name: "success", statuses: []int{200}, wantRequests: 1},
+		{name: "recovers", statuses: []int{500, 503, 200}, wantRequests: 3},
+		{name: "too many requests", statuses: []int{429, 200}, wantRequests: 2},
+		{name: "keeps failing", statuses: []int{500}, wantRequests: 3, wantStatus: 500},
+		{name: "unauthorized isn't retried", statuses: []int{401}, wantRequests: 1, wantStatus: 401},
+		{name: "denied isn't retried", statuses: []int{403}, wantRequests: 1, wantStatus: 403},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := statusServer(t, test.statuses...)
+			s := newTestService(t, server.URL, Config{Retries: 2, RetryBackoff: time.Millisecond})
+
+			err := s.Get(context.Background(), "authorized/04A1B2C3/door", time.Second, 200, &MediaConfig{})
+			if got := requests.Load(); got != test.wantRequests {
+				t.Errorf("made %v requests, want %v", got, test.wantRequests)
+			}
+			if test.wantStatus == 0 {
+				if err != nil {
+					t.Errorf("Get: unexpected error: %v", err)
+				}
+				return
+			}
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != test.wantStatus {
+				t.Errorf("Get: got %v, want a %v", err, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestGetRetriesNoResponse(t *testing.T) {
+	server, requests := statusServer(t, 200)
+	server.Close()
+	s := newTestService(t, server.URL, Config{Retries: 2, RetryBackoff: time.Millisecond})
+
+	err := s.Get(context.Background(), "authorized/04A1B2C3/door", time.Second, 200, &MediaConfig{})
+	var requestErr *RequestError
+	if !errors.As(err, &requestErr) {
+		t.Errorf("Get: got %v, want a RequestError", err)
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("the closed server received %v requests", got)
+	}
+}
+
+func TestPostIsNotRetried(t *testing.T) {
+	server, requests := statusServer(t, 500, 201)
+	s := newTestService(t, server.URL, Config{Retries: 2, RetryBackoff: time.Millisecond})
+
+	if err := s.Post(context.Background(), "audit", time.Second, AuditEvent{UID: "04A1B2C3"}, 201, nil); err == nil {
+		t.Error("Post: got no error, want the 500")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("made %v requests, want 1", got)
+	}
+}
+
+func TestGetOpensBreaker(t *testing.T) {
+	server, requests := statusServer(t, 500, 500, 200)
+	s := newTestService(t, server.URL, Config{Retries: 1, RetryBackoff: time.Millisecond, BreakerThreshold: 1, BreakerCooldown: testCooldown})
+
+	// The retries are part of a single call as far as the breaker is concerned
+	if err := s.Get(context.Background(), "authorized/04A1B2C3/door", time.Second, 200, &MediaConfig{}); err == nil {
+		t.Fatal("Get: got no error, want the 500")
+	}
+	if state := s.Breaker().State; state != OPEN {
+		t.Fatalf("got breaker %v, want %v", state, OPEN)
+	}
+	if err := s.Get(context.Background(), "authorized/04A1B2C3/door", time.Second, 200, &MediaConfig{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Get while open: got %v, want %v", err, ErrCircuitOpen)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("made %v requests, want 2", got)
+	}
+
+	time.Sleep(testCooldown + 5*time.Millisecond)
+	if err := s.Get(context.Background(), "authorized/04A1B2C3/door", time.Second, 200, &MediaConfig{}); err != nil {
+		t.Errorf("Get after the cooldown: unexpected error: %v", err)
+	}
+	if state := s.Breaker().State; state != CLOSED {
+		t.Errorf("got breaker %v, want %v", state, CLOSED)
+	}
+}
+
+func TestGetCancelledDoesNotOpenBreaker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+	s := newTestService(t, server.URL, Config{Retries: 2, RetryBackoff: time.Millisecond, BreakerThreshold: 1, BreakerCooldown: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := s.Get(ctx, "authorized/04A1B2C3/door", time.Second, 200, &MediaConfig{}); err == nil {
+		t.Fatal("Get: got no error, want it cancelled")
+	}
+	if status := s.Breaker(); status.State != CLOSED || status.Failures != 0 {
+		t.Errorf("got breaker %v with %v failures, want %v with 0", status.State, status.Failures, CLOSED)
+	}
+}
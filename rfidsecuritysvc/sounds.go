@@ -1,6 +1,7 @@
 package rfidsecuritysvc
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -11,7 +12,11 @@ const (
 
 type SoundService interface {
 	List() ([]Sound, error)
+	// ListContext is List but cancelling ctx aborts the request
+	ListContext(ctx context.Context) ([]Sound, error)
 	Get(id int) (*Sound, error)
+	// GetContext is Get but cancelling ctx aborts the request
+	GetContext(ctx context.Context, id int) (*Sound, error)
 }
 
 func (s *service) Sounds() SoundService {
@@ -25,16 +30,24 @@ type soundService struct {
 }
 
 func (s *soundService) List() ([]Sound, error) {
+	return s.ListContext(context.Background())
+}
+
+func (s *soundService) ListContext(ctx context.Context) ([]Sound, error) {
 	var sounds []Sound
-	if err := s.base.Get(baseUrl, 200, &sounds); err != nil {
+	if err := s.base.Get(ctx, baseUrl, s.base.config.SyncTimeout, 200, &sounds); err != nil {
 		return nil, err
 	}
 	return sounds, nil
 }
 
 func (s *soundService) Get(id int) (*Sound, error) {
+	return s.GetContext(context.Background(), id)
+}
+
+func (s *soundService) GetContext(ctx context.Context, id int) (*Sound, error) {
 	var sound Sound
-	if err := s.base.Get(fmt.Sprintf(getUrlFormat, id), 200, &sound); err != nil {
+	if err := s.base.Get(ctx, fmt.Sprintf(getUrlFormat, id), s.base.config.SyncTimeout, 200, &sound); err != nil {
 		return nil, err
 	}
 	return &sound, nil
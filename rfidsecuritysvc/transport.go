@@ -3,6 +3,7 @@ package rfidsecuritysvc
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -16,13 +17,32 @@ type authorizingTransport struct {
 }
 
 func (t *authorizingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Add("X-RFIDSECURITYSVC-API-KEY", url.QueryEscape(t.apiKey))
+	// With mTLS the client certificate may be all the authentication needed
+	if t.apiKey != "" {
+		req.Header.Add("X-RFIDSECURITYSVC-API-KEY", url.QueryEscape(t.apiKey))
+	}
 	return t.transport.RoundTrip(req)
 }
 
-func createTransport(apiSSLVerify string, apiKey string) (*authorizingTransport, error) {
+func createTransport(config Config) (*authorizingTransport, error) {
+	apiSSLVerify := config.SSLVerify
 	transport := http.DefaultTransport.(*http.Transport).Clone()
-	tlsConfig := &tls.Config{}
+	tlsConfig := &tls.Config{
+		// Overrides the host name in the URL for SNI and validating the certificate, e.g. when the service
+		// is reached by IP address
+		ServerName: config.TLSServerName,
+	}
+
+	if config.TLSClientCertFile != "" || config.TLSClientKeyFile != "" {
+		if config.TLSClientCertFile == "" || config.TLSClientKeyFile == "" {
+			return nil, errors.New("invalid value for api-tls-client-cert/api-tls-client-key: both must be set to use a client certificate")
+		}
+		reloader, err := newCertificateReloader(config.TLSClientCertFile, config.TLSClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
 
 	// apiSSLVerify can either be a boolean false or a file name
 	validateCertificates, err := isBool(apiSSLVerify)
@@ -47,7 +67,7 @@ func createTransport(apiSSLVerify string, apiKey string) (*authorizingTransport,
 
 	authorizingTransport := &authorizingTransport{
 		transport: transport,
-		apiKey:    apiKey,
+		apiKey:    config.APIKey,
 	}
 
 	return authorizingTransport, nil
@@ -44,3 +44,15 @@ type MediaConfig struct {
 	Sound      *Sound      `json:"sound"`
 	Color      *Color      `json:"color"`
 }
+
+// AuditEvent is the outcome of a single read, ID is unique to the read so the service can ignore one it
+// has already received
+type AuditEvent struct {
+	ID         string    `json:"id"`
+	UID        string    `json:"uid"`
+	Permission string    `json:"permission"`
+	Outcome    string    `json:"outcome"`
+	Reason     string    `json:"reason,omitempty"`
+	ReaderID   string    `json:"reader_id"`
+	Timestamp  time.Time `json:"timestamp"`
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -14,90 +19,239 @@ import (
 
 	readerctx "github.com/bcurnow/magicband-reader/context"
 	"github.com/bcurnow/magicband-reader/event"
-	_ "github.com/bcurnow/magicband-reader/handler"
+	"github.com/bcurnow/magicband-reader/metrics"
+	"github.com/bcurnow/magicband-reader/reader"
+	"github.com/bcurnow/magicband-reader/rfidsecuritysvc"
 )
 
+// How long a handler which timed out has to return once its context is cancelled before the pipeline
+// carries on without it
+var handlerStopTimeout = 2 * time.Second
+
 type Router interface {
-	Route(event event.Event) error
+	// Route handles event, cancelling ctx aborts any calls the handlers are making to other services
+	Route(ctx context.Context, event event.Event) error
 	Close()
-	Closed() bool
+}
+
+// RouterConfig holds the settings of the router and its HTTP listener
+type RouterConfig struct {
+	ListenAddress string
+	ListenPort    int
+	// If set, every request other than the health checks must include it in the X-MAGICBAND-READER-API-KEY header
+	APIKey string
+	// The certificate and key to serve TLS with, TLS is only enabled if these are set
+	TLSCertFile string
+	TLSKeyFile  string
+	// If set, clients must present a certificate signed by one of these CAs (requires TLS)
+	TLSClientCAFile string
+	// If true, a read which is handed to web waiters isn't sent to the handlers
+	WaitersSuppressHandlers bool
+	// If true, the admin endpoints are enabled (requires APIKey or TLSClientCAFile)
+	AdminAPI bool
+	// The IDs of the configured readers, /simulate/read defaults to the first
+	ReaderIDs []string
 }
 
 type router struct {
-	server            *http.Server
-	webChannel        chan event.Event
-	webRequestChannel chan bool
-	closed            bool
-	listenAddress     string
-	listenPort        int
+	config      RouterConfig
+	server      *http.Server
+	waiters     *webWaiters
+	broadcaster *broadcaster
+	// The components reported by /readyz by name
+	readiness     map[string]readinessCheck
+	readinessLock sync.RWMutex
+	// Events can arrive from more than one reader at a time, the handlers share state so only
+	// one event is routed at a time
+	routeLock sync.Mutex
 }
 
-func NewRouter(listenAddress string, listenPort int) (*router, error) {
-	router := router{listenAddress: listenAddress, listenPort: listenPort}
+func NewRouter(config RouterConfig) (*router, error) {
+	router := router{config: config}
 	if err := router.init(); err != nil {
 		return nil, err
 	}
 	return &router, nil
 }
 
-func (r *router) Route(event event.Event) error {
-	log.Tracef("Starting Route, state: %#v", readerctx.State)
-	select {
-	case <-r.webRequestChannel:
-		// There is a web request waiting for an event
-		r.webChannel <- event
-		log.Tracef("Web Route complete, state: %#v", readerctx.State)
-		return nil
-	default:
-		// There is no web request waiting, send to handlers
-		err := r.handle(event)
-		log.Tracef("Default Route complete, state: %#v", readerctx.State)
-		return err
+func (r *router) Route(ctx context.Context, event event.Event) error {
+	_, err := r.route(ctx, event)
+	return err
+}
+
+// route sends event to the web waiters and/or the handlers and returns the result
+func (r *router) route(ctx context.Context, event event.Event) (readResult, error) {
+	r.routeLock.Lock()
+	defer r.routeLock.Unlock()
+	log.Tracef("Starting Route for %v", event)
+	metrics.Reads.WithLabelValues(event.ReaderID()).Inc()
+	r.broadcaster.publish(newStreamMessage(streamRead, event, nil))
+	if r.config.WaitersSuppressHandlers {
+		if waiting := r.waiters.deliver(newReadResult(event, nil)); waiting > 0 {
+			// The web requests waiting for an event take it instead of the handlers
+			metrics.Events.WithLabelValues(event.ReaderID(), event.Type().String(), event.Reason().String()).Inc()
+			r.broadcaster.publish(newStreamMessage(streamResult, event, nil))
+			log.Tracef("Web Route complete (%v waiters)", waiting)
+			return newReadResult(event, nil), nil
+		}
+	}
+
+	mediaConfig, err := r.handle(ctx, event)
+	metrics.Events.WithLabelValues(event.ReaderID(), event.Type().String(), event.Reason().String()).Inc()
+	result := newReadResult(event, mediaConfig)
+	r.broadcaster.publish(streamMessage{readResult: result, stage: streamResult})
+	if !r.config.WaitersSuppressHandlers {
+		// The web requests are watching alongside the handlers, they get the event once it's handled
+		r.waiters.deliver(result)
 	}
+	log.Trace("Default Route complete")
+	return result, err
+}
+
+// readResult is the JSON representation of a read, it's returned by /get_uid and streamed by /events
+type readResult struct {
+	ReaderID  string     `json:"reader_id"`
+	UID       string     `json:"uid"`
+	Timestamp time.Time  `json:"timestamp"`
+	TagType   string     `json:"tag_type,omitempty"`
+	Tag       *event.Tag `json:"tag,omitempty"`
+	// The authorization outcome, UNKNOWN if the read wasn't sent through the handlers
+	Type string `json:"type"`
+	// Why the band is UNAUTHORIZED: DENIED, UNKNOWN_MEDIA, SERVICE_ERROR or TIMEOUT
+	Reason      string                       `json:"reason,omitempty"`
+	MediaConfig *rfidsecuritysvc.MediaConfig `json:"media_config,omitempty"`
+}
+
+func newReadResult(e event.Event, mediaConfig *rfidsecuritysvc.MediaConfig) readResult {
+	result := readResult{
+		ReaderID:    e.ReaderID(),
+		UID:         e.UID(),
+		Timestamp:   e.Timestamp(),
+		Tag:         e.Tag(),
+		Type:        e.Type().String(),
+		Reason:      e.Reason().String(),
+		MediaConfig: mediaConfig,
+	}
+	if e.Tag() != nil {
+		result.TagType = e.Tag().Type
+	}
+	return result
+}
+
+// errorResult is the JSON body of an unsuccessful /get_uid request
+type errorResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
 }
 
 func (r *router) Close() {
 	log.Trace("Closing Router")
-	r.closed = true
+	// The streams never finish on their own and waiters can wait a long time, end them so the server
+	// can shutdown
+	r.broadcaster.close()
+	r.waiters.close()
 	log.Trace("Shutting down the server")
 	if err := r.server.Shutdown(context.Background()); err != nil {
 		log.Errorf("Error during shutdown: %v", err)
 	}
 	log.Trace("Server shutdown")
-	close(r.webChannel)
-	close(r.webRequestChannel)
 	log.Trace("Router closed")
 }
 
-func (r *router) Closed() bool {
-	return r.closed
-}
-
 func (r *router) init() error {
-	r.server = r.createServer()
-	r.webChannel = make(chan event.Event)
-	r.webRequestChannel = make(chan bool)
+	if err := validateAdminConfig(r.config); err != nil {
+		return err
+	}
+	tlsConfig, err := createTLSConfig(r.config.TLSCertFile, r.config.TLSKeyFile, r.config.TLSClientCAFile)
+	if err != nil {
+		return err
+	}
+	r.broadcaster = newBroadcaster()
+	r.waiters = newWebWaiters()
+	r.readiness = make(map[string]readinessCheck)
+	r.addDefaultReadinessChecks()
+	r.server = r.createServer(tlsConfig)
 	return nil
 }
 
-func (r *router) createServer() *http.Server {
+func (r *router) createServer(tlsConfig *tls.Config) *http.Server {
+	scheme := "HTTP"
+	if tlsConfig != nil {
+		scheme = "HTTPS"
+	}
+
+	// The health checks are for orchestrators and load balancers which can't authenticate, they're
+	// outside the API key (but not TLS or client certificates)
 	muxer := mux.NewRouter()
-	muxer.Path("/get_uid").
+	muxer.Path("/healthz").
 		Methods(http.MethodGet).
-		Schemes("HTTP").
+		Schemes(scheme).
+		HandlerFunc(handleHealthRequest)
+	muxer.Path("/readyz").
+		Methods(http.MethodGet).
+		Schemes(scheme).
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			handleReadyRequest(r, w, req)
+		})
+
+	api := muxer.NewRoute().Subrouter()
+	api.Path("/get_uid").
+		Methods(http.MethodGet).
+		Schemes(scheme).
 		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			handleWebRequest(r, w, req)
 		})
+	api.Path("/metrics").
+		Methods(http.MethodGet).
+		Schemes(scheme).
+		Handler(metrics.Handler())
+	api.Path("/events").
+		Methods(http.MethodGet).
+		Schemes(scheme).
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			handleStreamRequest(r, w, req)
+		})
+	if r.config.AdminAPI {
+		api.Path("/led/effect").
+			Methods(http.MethodPost).
+			Schemes(scheme).
+			HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				handleLEDEffectRequest(r, w, req)
+			})
+		api.Path("/audio/play").
+			Methods(http.MethodPost).
+			Schemes(scheme).
+			HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				handleAudioPlayRequest(r, w, req)
+			})
+		api.Path("/simulate/read").
+			Methods(http.MethodPost).
+			Schemes(scheme).
+			HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				handleSimulateReadRequest(r, w, req)
+			})
+	}
+	if r.config.APIKey != "" {
+		api.Use(apiKeyMiddleware(r.config.APIKey))
+	}
 
-	address := fmt.Sprintf("%v:%v", r.listenAddress, r.listenPort)
+	address := fmt.Sprintf("%v:%v", r.config.ListenAddress, r.config.ListenPort)
 	server := http.Server{
-		Addr:    address,
-		Handler: muxer,
+		Addr:      address,
+		Handler:   muxer,
+		TLSConfig: tlsConfig,
 	}
 
 	go func() {
-		log.Infof("Starting server on %v", address)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Infof("Starting %v server on %v", scheme, address)
+		var err error
+		if tlsConfig != nil {
+			// The certificate is already loaded in the TLSConfig
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Errorf("Error during server startup: %v", err)
 		}
 	}()
@@ -108,54 +262,85 @@ func handleWebRequest(r *router, w http.ResponseWriter, req *http.Request) {
 	// Default timeout, 1 minute
 	timeout := 1 * time.Minute
 
-	// All response will be plain text
-	w.Header().Set("Content-Type", "text/plain")
+	// Responses are plain text unless the client asks for JSON
+	asJSON := acceptsJSON(req)
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+	}
 
 	vars := req.URL.Query()
 	log.Tracef("handleWebRequest: Received request with parameters: %v", sanitizeForLog(vars))
 	if _, exists := vars["timeout"]; exists {
 		parsedInt, err := strconv.ParseInt(vars["timeout"][0], 0, 64)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			writeResponse(w, []byte(err.Error()))
+			writeWebError(w, asJSON, http.StatusBadRequest, err.Error())
 			return
 		}
 		timeout = time.Duration(parsedInt) * time.Second
 	}
 
-	start := time.Now()
-	if err := sendWebRequest(r, timeout); err != nil {
-		w.WriteHeader(http.StatusRequestTimeout)
-		writeResponse(w, []byte(TimeoutError{}.Error()))
-		log.Debug("handleWebRequest: Request timed out sending on channel")
-		return
-	}
-	elapsed := time.Since(start)
-	log.Tracef("handleWebRequest: sent web request to channel in %v", elapsed)
-
-	// We shouldn't wait the full timeout again, subtrack the time it took to send the web request
-	// from the overall timeout
-	timeout = time.Duration(timeout.Nanoseconds() - elapsed.Nanoseconds())
+	results, cancel := r.waiters.wait()
+	defer cancel()
 
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
 	log.Debugf("handleWebRequest: Waiting for event with timeout: %v", timeout)
-	for {
-		select {
-		case <-timer.C:
-			w.WriteHeader(http.StatusRequestTimeout)
-			writeResponse(w, []byte(TimeoutError{}.Error()))
-			log.Debug("handleWebRequest: Request timed out")
+	select {
+	case <-timer.C:
+		writeWebError(w, asJSON, http.StatusRequestTimeout, reader.ErrTimeout.Error())
+		log.Debug("handleWebRequest: Request timed out")
+	case <-req.Context().Done():
+		log.Debug("handleWebRequest: Request cancelled by the client")
+	case result, ok := <-results:
+		if !ok {
+			writeWebError(w, asJSON, http.StatusServiceUnavailable, "shutting down")
+			log.Debug("handleWebRequest: Router closed while waiting")
 			return
-		case event := <-r.webChannel:
-			log.Debugf("handleWebRequest: Returned '%v'", event.UID())
-			writeResponse(w, []byte(event.UID()))
+		}
+		log.Debugf("handleWebRequest: Returned '%v' from reader '%v'", result.UID, result.ReaderID)
+		w.Header().Set("X-Reader-ID", result.ReaderID)
+		if !asJSON {
+			writeResponse(w, []byte(result.UID))
 			return
 		}
+		writeJSON(w, result)
 	}
 }
 
+// acceptsJSON returns true if the Accept header of req includes application/json
+func acceptsJSON(req *http.Request) bool {
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeWebError(w http.ResponseWriter, asJSON bool, status int, message string) {
+	w.WriteHeader(status)
+	if !asJSON {
+		writeResponse(w, []byte(message))
+		return
+	}
+	writeJSON(w, errorResult{Status: status, Error: message})
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Errorf("writeJSON: unable to marshal response: %v", err)
+		return
+	}
+	writeResponse(w, data)
+}
+
 // sanitizeForLog strips CR/LF from untrusted input before it's written to the log, so a
 // crafted query parameter can't forge additional log lines or corrupt log parsing.
 func sanitizeForLog(v interface{}) string {
@@ -169,25 +354,145 @@ func writeResponse(w http.ResponseWriter, body []byte) {
 	}
 }
 
-func sendWebRequest(r *router, timeout time.Duration) error {
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
-	for {
-		select {
-		case <-timer.C:
-			return errors.New("timed out sending web request")
-		case r.webRequestChannel <- true:
-			return nil
+// webWaiters are the /get_uid requests waiting for the next read, every waiter registered at the time
+// of a read receives it
+type webWaiters struct {
+	waiting map[chan readResult]bool
+	closed  bool
+	sync.Mutex
+}
+
+func newWebWaiters() *webWaiters {
+	return &webWaiters{waiting: make(map[chan readResult]bool)}
+}
+
+// wait registers a new waiter, the channel receives the next read and is closed if the router is
+// closed first. cancel must be called once the waiter is done.
+func (ww *webWaiters) wait() (chan readResult, func()) {
+	ww.Lock()
+	defer ww.Unlock()
+	// Buffered so deliver never blocks on a waiter
+	ch := make(chan readResult, 1)
+	if ww.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	ww.waiting[ch] = true
+	metrics.WebWaiters.Set(float64(len(ww.waiting)))
+	return ch, func() {
+		ww.Lock()
+		defer ww.Unlock()
+		delete(ww.waiting, ch)
+		metrics.WebWaiters.Set(float64(len(ww.waiting)))
+	}
+}
+
+// deliver hands result to every waiter and returns how many there were, each waiter only receives one read
+func (ww *webWaiters) deliver(result readResult) int {
+	ww.Lock()
+	defer ww.Unlock()
+	count := len(ww.waiting)
+	for ch := range ww.waiting {
+		ch <- result
+		delete(ww.waiting, ch)
+	}
+	metrics.WebWaiters.Set(0)
+	return count
+}
+
+func (ww *webWaiters) close() {
+	ww.Lock()
+	defer ww.Unlock()
+	ww.closed = true
+	for ch := range ww.waiting {
+		close(ch)
+		delete(ww.waiting, ch)
+	}
+}
+
+// handle runs event through the handlers and returns the media config of an authorized band, the state
+// the handlers share only lives as long as this event. Once a handler with the ABORT policy fails only the
+// CLEANUP handlers run, the errors of all the handlers which failed are returned.
+func (r *router) handle(ctx context.Context, event event.Event) (*rfidsecuritysvc.MediaConfig, error) {
+	pc := readerctx.NewPipelineContext(ctx)
+	var errs []error
+	aborted := false
+	for _, priority := range readerctx.SortedPriorities() {
+		registration := readerctx.Handlers[priority]
+		if aborted && registration.Policy != readerctx.CLEANUP {
+			log.Debugf("Skipping '%T', the pipeline was aborted", registration.Handler)
+			continue
+		}
+		log.Tracef("%T", registration.Handler)
+		start := time.Now()
+		err := runHandler(pc, registration, event)
+		metrics.HandlerDuration.WithLabelValues(strconv.Itoa(priority), fmt.Sprintf("%T", registration.Handler)).Observe(time.Since(start).Seconds())
+		if err == nil {
+			continue
+		}
+		errs = append(errs, err)
+		if registration.Policy == readerctx.ABORT {
+			log.Errorf("Aborting the pipeline for '%v': %v", event.UID(), err)
+			aborted = true
+		} else {
+			log.Errorf("Continuing the pipeline for '%v': %v", event.UID(), err)
 		}
 	}
+
+	// Anything still running in the background is stopped before the next event
+	pc.Close()
+	if len(errs) > 0 {
+		// The handlers which turn the LEDs off may not have run (or may be what failed)
+		if err := readerctx.LEDController.LightsOff(); err != nil {
+			log.Errorf("Unable to turn the LEDs off after the pipeline failed: %v", err)
+		}
+	}
+	return pc.MediaConfig(), errors.Join(errs...)
 }
 
-func (r *router) handle(event event.Event) error {
-	for _, h := range readerctx.SortedHandlers() {
-		log.Tracef("%T", h)
-		if err := h.Handle(event); err != nil {
-			return err
+// runHandler runs a single handler, a panic or running for longer than the timeout is returned as an error.
+// A handler which times out has its context cancelled and handlerStopTimeout to return, one which ignores
+// its context carries on in the background.
+func runHandler(pc *readerctx.PipelineContext, registration readerctx.Registration, event event.Event) error {
+	handlerName := fmt.Sprintf("%T", registration.Handler)
+	handlerPC, cancel := pc.ForHandler()
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Handler '%v' panicked: %v\n%s", handlerName, r, debug.Stack())
+				metrics.HandlerFailures.WithLabelValues(handlerName, "panic").Inc()
+				done <- fmt.Errorf("handler '%v' panicked: %v", handlerName, r)
+			}
+		}()
+		err := registration.Handler.Handle(handlerPC, event)
+		if err != nil {
+			metrics.HandlerFailures.WithLabelValues(handlerName, "error").Inc()
+			err = fmt.Errorf("handler '%v' failed: %w", handlerName, err)
 		}
+		done <- err
+	}()
+
+	if registration.Timeout <= 0 {
+		return <-done
 	}
-	return nil
+	timer := time.NewTimer(registration.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	metrics.HandlerFailures.WithLabelValues(handlerName, "timeout").Inc()
+	cancel()
+	stopTimer := time.NewTimer(handlerStopTimeout)
+	defer stopTimer.Stop()
+	select {
+	case <-done:
+	case <-stopTimer.C:
+		log.Errorf("Handler '%v' is still running %v after it was cancelled, carrying on without it", handlerName, handlerStopTimeout)
+	}
+	return fmt.Errorf("handler '%v' timed out after %v", handlerName, registration.Timeout)
 }
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	readerctx "github.com/bcurnow/magicband-reader/context"
+	"github.com/bcurnow/magicband-reader/event"
+	"github.com/bcurnow/magicband-reader/led"
+	"github.com/bcurnow/magicband-reader/reader"
+)
+
+// fakeLEDs counts how many times the LEDs are turned off
+type fakeLEDs struct {
+	led.Controller
+	lightsOff int
+}
+
+func (l *fakeLEDs) LightsOff() error {
+	l.lightsOff++
+	return nil
+}
+
+// recorder is the list of steps which ran, in the order they ran
+type recorder struct {
+	lock sync.Mutex
+	ran  []string
+}
+
+func (r *recorder) record(step string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ran = append(r.ran, step)
+}
+
+func (r *recorder) steps() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.ran...)
+}
+
+type behavior int
+
+const (
+	succeeds behavior = iota
+	fails
+	panics
+	// Waits until its context is cancelled
+	watchesContext
+	// Blocks until the test has finished
+	ignoresContext
+)
+
+type fakeHandler struct {
+	name     string
+	behavior behavior
+	recorder *recorder
+	// Closed once the test has finished
+	released chan struct{}
+}
+
+func (h *fakeHandler) Handle(pc *readerctx.PipelineContext, e event.Event) error {
+	switch h.behavior {
+	case fails:
+		h.recorder.record(h.name)
+		return errors.New(h.name + " failed")
+	case panics:
+		h.recorder.record(h.name)
+		panic(h.name + " panicked")
+	case watchesContext:
+		<-pc.Context().Done()
+		h.recorder.record(h.name + " cancelled")
+		return pc.Context().Err()
+	case ignoresContext:
+		<-h.released
+		return nil
+	}
+	h.recorder.record(h.name)
+	return nil
+}
+
+type step struct {
+	name     string
+	behavior behavior
+	policy   readerctx.Policy
+	timeout  time.Duration
+}
+
+func TestHandle(t *testing.T) {
+	handlerStopTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name  string
+		steps []step
+		want  []string
+		// Each error the pipeline is expected to return, nil if it should succeed
+		wantErrs []string
+	}{
+		{
+			name: "succeeds",
+			steps: []step{
+				{name: "read-sound"},
+				{name: "authorize"},
+				{name: "logging", policy: readerctx.CLEANUP},
+			},
+			want: []string{"read-sound", "authorize", "logging"},
+		},
+		{
+			name: "abort skips all but cleanup",
+			steps: []step{
+				{name: "authorize", behavior: fails},
+				{name: "show-status"},
+				{name: "auth-sound", policy: readerctx.CONTINUE},
+				{name: "stop-status", policy: readerctx.CLEANUP},
+				{name: "logging", policy: readerctx.CLEANUP},
+			},
+			want:     []string{"authorize", "stop-status", "logging"},
+			wantErrs: []string{"authorize failed"},
+		},
+		{
+			name: "continue",
+			steps: []step{
+				{name: "show-status", behavior: fails, policy: readerctx.CONTINUE},
+				{name: "auth-sound"},
+			},
+			want:     []string{"show-status", "auth-sound"},
+			wantErrs: []string{"show-status failed"},
+		},
+		{
+			name: "failed cleanup",
+			steps: []step{
+				{name: "authorize", behavior: fails},
+				{name: "stop-status", behavior: fails, policy: readerctx.CLEANUP},
+				{name: "logging", policy: readerctx.CLEANUP},
+			},
+			want:     []string{"authorize", "stop-status", "logging"},
+			wantErrs: []string{"authorize failed", "stop-status failed"},
+		},
+		{
+			name: "panic",
+			steps: []step{
+				{name: "authorize", behavior: panics},
+				{name: "show-status"},
+				{name: "logging", policy: readerctx.CLEANUP},
+			},
+			want:     []string{"authorize", "logging"},
+			wantErrs: []string{"panicked: authorize panicked"},
+		},
+		{
+			name: "timeout cancels the handler",
+			steps: []step{
+				{name: "authorize", behavior: watchesContext, timeout: 20 * time.Millisecond},
+				{name: "show-status"},
+				{name: "logging", policy: readerctx.CLEANUP},
+			},
+			// The pipeline waits for the handler to return before it carries on
+			want:     []string{"authorize cancelled", "logging"},
+			wantErrs: []string{"timed out after 20ms"},
+		},
+		{
+			name: "timeout of a handler which ignores its context",
+			steps: []step{
+				{name: "authorize", behavior: ignoresContext, timeout: 20 * time.Millisecond},
+				{name: "logging", policy: readerctx.CLEANUP},
+			},
+			want:     []string{"logging"},
+			wantErrs: []string{"timed out after 20ms"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := &recorder{}
+			released := make(chan struct{})
+			defer close(released)
+			leds := &fakeLEDs{}
+			readerctx.LEDController = leds
+			readerctx.Handlers = make(map[int]readerctx.Registration)
+			for i, s := range test.steps {
+				h := &fakeHandler{name: s.name, behavior: s.behavior, recorder: rec, released: released}
+				if err := readerctx.RegisterHandler(i, readerctx.Registration{Handler: h, Policy: s.policy, Timeout: s.timeout}); err != nil {
+					t.Fatalf("RegisterHandler: %v", err)
+				}
+			}
+
+			r := &router{}
+			_, err := r.handle(context.Background(), event.NewEvent("test", "04A1B2C3", event.UNKNOWN))
+
+			if got := rec.steps(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ran %v, want %v", got, test.want)
+			}
+			if len(test.wantErrs) == 0 {
+				if err != nil {
+					t.Errorf("handle: unexpected error: %v", err)
+				}
+				if leds.lightsOff != 0 {
+					t.Errorf("the LEDs were turned off %v times, want 0", leds.lightsOff)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("handle: got no error, want %v", test.wantErrs)
+			}
+			for _, wantErr := range test.wantErrs {
+				if !strings.Contains(err.Error(), wantErr) {
+					t.Errorf("handle: got error %v, want one containing '%v'", err, wantErr)
+				}
+			}
+			if leds.lightsOff != 1 {
+				t.Errorf("the LEDs were turned off %v times, want 1", leds.lightsOff)
+			}
+		})
+	}
+}
+
+// newTestRouter creates a router listening on a random port, the requests in the tests are sent straight to
+// its handler
+func newTestRouter(t *testing.T, config RouterConfig) *router {
+	t.Helper()
+	config.ListenAddress = "127.0.0.1"
+	r, err := NewRouter(config)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestAPIKey(t *testing.T) {
+	r := newTestRouter(t, RouterConfig{APIKey: "secret"})
+
+	tests := []struct {
+		path   string
+		apiKey string
+		want   int
+	}{
+		{path: "/healthz", want: http.StatusOK},
+		// Nothing has been initialized so it's not ready, but it didn't need the API key to say so
+		{path: "/readyz", want: http.StatusServiceUnavailable},
+		{path: "/get_uid", want: http.StatusUnauthorized},
+		{path: "/get_uid", apiKey: "wrong", want: http.StatusUnauthorized},
+		{path: "/metrics", want: http.StatusUnauthorized},
+		{path: "/metrics", apiKey: "secret", want: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.apiKey != "" {
+				req.Header.Set(apiKeyHeader, test.apiKey)
+			}
+			w := httptest.NewRecorder()
+			r.server.Handler.ServeHTTP(w, req)
+			if w.Code != test.want {
+				t.Errorf("got status %v, want %v", w.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestWebWaitersDeliverToEveryWaiter(t *testing.T) {
+	ww := newWebWaiters()
+	waiters := make([]chan readResult, 3)
+	for i := range waiters {
+		ch, cancel := ww.wait()
+		defer cancel()
+		waiters[i] = ch
+	}
+
+	if count := ww.deliver(readResult{UID: "04A1B2C3"}); count != len(waiters) {
+		t.Errorf("delivered to %v waiters, want %v", count, len(waiters))
+	}
+	for i, ch := range waiters {
+		select {
+		case result := <-ch:
+			if result.UID != "04A1B2C3" {
+				t.Errorf("waiter %v: got '%v', want '04A1B2C3'", i, result.UID)
+			}
+		default:
+			t.Errorf("waiter %v didn't receive the read", i)
+		}
+	}
+
+	// Each waiter only receives one read, the next one is for whoever is waiting then
+	if count := ww.deliver(readResult{UID: "04D5E6F7"}); count != 0 {
+		t.Errorf("delivered the second read to %v waiters, want 0", count)
+	}
+	for i, ch := range waiters {
+		if len(ch) != 0 {
+			t.Errorf("waiter %v received a second read", i)
+		}
+	}
+}
+
+func TestWebWaitersCancelAndClose(t *testing.T) {
+	ww := newWebWaiters()
+	cancelled, cancel := ww.wait()
+	cancel()
+	waiting, cancelWaiting := ww.wait()
+	defer cancelWaiting()
+
+	if count := ww.deliver(readResult{UID: "04A1B2C3"}); count != 1 {
+		t.Errorf("delivered to %v waiters, want 1", count)
+	}
+	if len(cancelled) != 0 {
+		t.Error("a cancelled waiter received the read")
+	}
+	<-waiting
+
+	waiting, cancelWaiting = ww.wait()
+	defer cancelWaiting()
+	ww.close()
+	if _, ok := <-waiting; ok {
+		t.Error("the waiter is still open after close")
+	}
+	closed, _ := ww.wait()
+	if _, ok := <-closed; ok {
+		t.Error("wait after close returned an open channel")
+	}
+}
+
+// waitForWaiters waits until count /get_uid requests are waiting
+func waitForWaiters(t *testing.T, r *router, count int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.waiters.Lock()
+		waiting := len(r.waiters.waiting)
+		r.waiters.Unlock()
+		if waiting == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v requests are waiting, want %v", waiting, count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRouteToWebWaiters(t *testing.T) {
+	rec := &recorder{}
+	readerctx.Handlers = make(map[int]readerctx.Registration)
+	if err := readerctx.RegisterHandler(0, readerctx.Registration{Handler: &fakeHandler{name: "authorize", recorder: rec}}); err != nil {
+		t.Fatalf("RegisterHandler: %v", err)
+	}
+	r := newTestRouter(t, RouterConfig{WaitersSuppressHandlers: true})
+
+	const requests = 3
+	uids := make(chan string, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			results, cancel := r.waiters.wait()
+			defer cancel()
+			uids <- (<-results).UID
+		}()
+	}
+	waitForWaiters(t, r, requests)
+
+	if err := r.Route(context.Background(), event.NewEvent("default", "04A1B2C3", event.UNKNOWN)); err != nil {
+		t.Fatalf("Route: %v", err)
+	}
+	for i := 0; i < requests; i++ {
+		if uid := <-uids; uid != "04A1B2C3" {
+			t.Errorf("got '%v', want '04A1B2C3'", uid)
+		}
+	}
+	if ran := rec.steps(); len(ran) != 0 {
+		t.Errorf("the handlers ran %v, want none while requests are waiting", ran)
+	}
+
+	// Nobody is waiting for the next read, the handlers get it
+	if err := r.Route(context.Background(), event.NewEvent("default", "04D5E6F7", event.UNKNOWN)); err != nil {
+		t.Fatalf("Route: %v", err)
+	}
+	if ran := rec.steps(); !reflect.DeepEqual(ran, []string{"authorize"}) {
+		t.Errorf("the handlers ran %v, want [authorize]", ran)
+	}
+}
+
+func TestGetUID(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		accept     string
+		route      bool
+		wantStatus int
+		wantType   string
+		wantBody   string
+		wantJSON   interface{}
+		wantReader string
+	}{
+		{
+			name:       "plain text",
+			route:      true,
+			wantStatus: http.StatusOK,
+			wantType:   "text/plain",
+			wantBody:   "04A1B2C3",
+			wantReader: "front-door",
+		},
+		{
+			name:       "JSON",
+			accept:     "text/html, application/json;q=0.9",
+			route:      true,
+			wantStatus: http.StatusOK,
+			wantType:   "application/json",
+			wantJSON:   &readResult{ReaderID: "front-door", UID: "04A1B2C3", Type: event.UNKNOWN.String(), Reason: event.NO_REASON.String()},
+			wantReader: "front-door",
+		},
+		{
+			name:       "JSON timeout",
+			query:      "?timeout=0",
+			accept:     "application/json",
+			wantStatus: http.StatusRequestTimeout,
+			wantType:   "application/json",
+			wantJSON:   &errorResult{Status: http.StatusRequestTimeout, Error: reader.ErrTimeout.Error()},
+		},
+		{
+			name:       "JSON bad timeout",
+			query:      "?timeout=soon",
+			accept:     "application/json",
+			wantStatus: http.StatusBadRequest,
+			wantType:   "application/json",
+			wantJSON:   &errorResult{Status: http.StatusBadRequest, Error: `strconv.ParseInt: parsing "soon": invalid syntax`},
+		},
+		{
+			name:       "plain text bad timeout",
+			query:      "?timeout=soon",
+			wantStatus: http.StatusBadRequest,
+			wantType:   "text/plain",
+			wantBody:   `strconv.ParseInt: parsing "soon": invalid syntax`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRouter(t, RouterConfig{WaitersSuppressHandlers: true})
+			req := httptest.NewRequest(http.MethodGet, "/get_uid"+test.query, nil)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			w := httptest.NewRecorder()
+			done := make(chan bool)
+			go func() {
+				defer close(done)
+				r.server.Handler.ServeHTTP(w, req)
+			}()
+
+			e := event.NewEvent("front-door", "04A1B2C3", event.UNKNOWN)
+			if test.route {
+				waitForWaiters(t, r, 1)
+				if err := r.Route(context.Background(), e); err != nil {
+					t.Fatalf("Route: %v", err)
+				}
+			}
+			<-done
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %v, want %v", w.Code, test.wantStatus)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != test.wantType {
+				t.Errorf("got Content-Type '%v', want '%v'", contentType, test.wantType)
+			}
+			if readerID := w.Header().Get("X-Reader-ID"); readerID != test.wantReader {
+				t.Errorf("got X-Reader-ID '%v', want '%v'", readerID, test.wantReader)
+			}
+			if test.wantJSON == nil {
+				if body := w.Body.String(); body != test.wantBody {
+					t.Errorf("got body '%v', want '%v'", body, test.wantBody)
+				}
+				return
+			}
+
+			// A fresh value of the same type as wantJSON to unmarshal into
+			got := reflect.New(reflect.TypeOf(test.wantJSON).Elem()).Interface()
+			if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+				t.Fatalf("unable to unmarshal '%v': %v", w.Body.String(), err)
+			}
+			if result, ok := got.(*readResult); ok {
+				if !result.Timestamp.Equal(e.Timestamp()) {
+					t.Errorf("got timestamp %v, want %v", result.Timestamp, e.Timestamp())
+				}
+				result.Timestamp = time.Time{}
+			}
+			if !reflect.DeepEqual(got, test.wantJSON) {
+				t.Errorf("got %+v, want %+v", got, test.wantJSON)
+			}
+		})
+	}
+}
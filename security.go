@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Mirrors the X-RFIDSECURITYSVC-API-KEY header used to call rfid-security-svc, the value is query escaped
+	apiKeyHeader = "X-MAGICBAND-READER-API-KEY"
+)
+
+// createTLSConfig returns the TLS config for the listener or nil if TLS isn't enabled
+func createTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("invalid value for listen-tls-client-ca: '%v', listen-tls-cert and listen-tls-key must also be set", clientCAFile)
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("invalid value for listen-tls-cert/listen-tls-key: both must be set to enable TLS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for listen-tls-cert/listen-tls-key: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		caCerts, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for listen-tls-client-ca: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caCerts) {
+			return nil, fmt.Errorf("invalid value for listen-tls-client-ca: '%v', no certificates found", clientCAFile)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// apiKeyMiddleware rejects any request which doesn't have apiKey in the X-MAGICBAND-READER-API-KEY header
+func apiKeyMiddleware(apiKey string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			provided, err := url.QueryUnescape(req.Header.Get(apiKeyHeader))
+			if err != nil || subtle.ConstantTimeCompare([]byte(provided), []byte(apiKey)) != 1 {
+				log.Warnf("Rejected request for '%v' from %v: missing or invalid %v", sanitizeForLog(req.URL.Path), req.RemoteAddr, apiKeyHeader)
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusUnauthorized)
+				writeResponse(w, []byte("unauthorized"))
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
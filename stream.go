@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bcurnow/magicband-reader/event"
+	"github.com/bcurnow/magicband-reader/metrics"
+	"github.com/bcurnow/magicband-reader/rfidsecuritysvc"
+)
+
+const (
+	// A message is sent when a band is read and again once the handlers have finished with it
+	streamRead   = "read"
+	streamResult = "result"
+
+	// How many messages can be queued for a slow subscriber before they're dropped
+	streamBufferSize = 16
+	// Comments are sent this often so proxies don't close an idle stream
+	streamKeepAlive = 15 * time.Second
+)
+
+type streamMessage struct {
+	readResult
+	stage string
+}
+
+// broadcaster hands every message to all the current subscribers, a subscriber which isn't keeping up
+// misses messages rather than holding up the reads
+type broadcaster struct {
+	subscribers map[chan streamMessage]bool
+	closed      bool
+	sync.Mutex
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subscribers: make(map[chan streamMessage]bool)}
+}
+
+// subscribe returns the channel messages are delivered on, it's closed when the broadcaster is closed
+// or unsubscribe is called
+func (b *broadcaster) subscribe() (chan streamMessage, func()) {
+	b.Lock()
+	defer b.Unlock()
+	ch := make(chan streamMessage, streamBufferSize)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subscribers[ch] = true
+	metrics.StreamSubscribers.Set(float64(len(b.subscribers)))
+	return ch, func() {
+		b.Lock()
+		defer b.Unlock()
+		if b.subscribers[ch] {
+			delete(b.subscribers, ch)
+			close(ch)
+			metrics.StreamSubscribers.Set(float64(len(b.subscribers)))
+		}
+	}
+}
+
+func (b *broadcaster) publish(message streamMessage) {
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- message:
+		default:
+			log.Warnf("broadcaster: subscriber is too slow, dropped %v message for '%v'", message.stage, message.UID)
+		}
+	}
+}
+
+func (b *broadcaster) close() {
+	b.Lock()
+	defer b.Unlock()
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+	metrics.StreamSubscribers.Set(0)
+}
+
+func newStreamMessage(stage string, e event.Event, mediaConfig *rfidsecuritysvc.MediaConfig) streamMessage {
+	return streamMessage{readResult: newReadResult(e, mediaConfig), stage: stage}
+}
+
+// handleStreamRequest streams every read and its result as Server-Sent Events until the client goes away
+func handleStreamRequest(r *router, w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeResponse(w, []byte("streaming is not supported"))
+		return
+	}
+
+	messages, unsubscribe := r.broadcaster.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	log.Debugf("handleStreamRequest: %v subscribed", req.RemoteAddr)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			log.Debugf("handleStreamRequest: %v unsubscribed", req.RemoteAddr)
+			return
+		case <-keepAlive.C:
+			writeResponse(w, []byte(": keep-alive\n\n"))
+		case message, ok := <-messages:
+			if !ok {
+				// Shutting down
+				return
+			}
+			data, err := json.Marshal(message)
+			if err != nil {
+				log.Errorf("handleStreamRequest: unable to marshal message: %v", err)
+				continue
+			}
+			writeResponse(w, []byte(fmt.Sprintf("event: %v\ndata: %s\n\n", message.stage, data)))
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcurnow/magicband-reader/event"
+)
+
+func testMessage(stage string, uid string) streamMessage {
+	return newStreamMessage(stage, event.NewEvent("default", uid, event.UNKNOWN), nil)
+}
+
+// receive fails the test unless ch delivers a message within a second
+func receive(t *testing.T, ch chan streamMessage) streamMessage {
+	t.Helper()
+	select {
+	case message, ok := <-ch:
+		if !ok {
+			t.Fatal("the subscription was closed")
+		}
+		return message
+	case <-time.After(time.Second):
+		t.Fatal("no message was received")
+	}
+	return streamMessage{}
+}
+
+func TestBroadcasterFanOut(t *testing.T) {
+	b := newBroadcaster()
+	subscribers := make([]chan streamMessage, 3)
+	for i := range subscribers {
+		ch, unsubscribe := b.subscribe()
+		defer unsubscribe()
+		subscribers[i] = ch
+	}
+
+	b.publish(testMessage(streamRead, "04A1B2C3"))
+	b.publish(testMessage(streamResult, "04A1B2C3"))
+	for i, ch := range subscribers {
+		for _, want := range []string{streamRead, streamResult} {
+			if got := receive(t, ch); got.stage != want || got.UID != "04A1B2C3" {
+				t.Errorf("subscriber %v: got %v for '%v', want %v for '04A1B2C3'", i, got.stage, got.UID, want)
+			}
+		}
+	}
+}
+
+func TestBroadcasterUnsubscribe(t *testing.T) {
+	b := newBroadcaster()
+	ch, unsubscribe := b.subscribe()
+	other, unsubscribeOther := b.subscribe()
+	defer unsubscribeOther()
+
+	unsubscribe()
+	// Safe to call more than once, e.g. once by the request and again by a deferred call
+	unsubscribe()
+	if _, ok := <-ch; ok {
+		t.Error("the channel is still open after unsubscribe")
+	}
+	if len(b.subscribers) != 1 {
+		t.Errorf("got %v subscribers, want 1", len(b.subscribers))
+	}
+
+	b.publish(testMessage(streamRead, "04A1B2C3"))
+	receive(t, other)
+}
+
+func TestBroadcasterSlowSubscriber(t *testing.T) {
+	b := newBroadcaster()
+	slow, unsubscribeSlow := b.subscribe()
+	defer unsubscribeSlow()
+	fast, unsubscribeFast := b.subscribe()
+	defer unsubscribeFast()
+
+	// publish never blocks, the slow subscriber only misses what doesn't fit in its buffer
+	for i := 0; i < streamBufferSize+5; i++ {
+		b.publish(testMessage(streamRead, "04A1B2C3"))
+		receive(t, fast)
+	}
+	if len(slow) != streamBufferSize {
+		t.Errorf("the slow subscriber has %v messages queued, want %v", len(slow), streamBufferSize)
+	}
+}
+
+func TestBroadcasterClose(t *testing.T) {
+	b := newBroadcaster()
+	ch, unsubscribe := b.subscribe()
+	b.close()
+	if _, ok := <-ch; ok {
+		t.Error("the channel is still open after close")
+	}
+	// Unsubscribing after the broadcaster is closed is a no-op
+	unsubscribe()
+
+	ch, _ = b.subscribe()
+	if _, ok := <-ch; ok {
+		t.Error("subscribe after close returned an open channel")
+	}
+}
+
+func TestStreamRequest(t *testing.T) {
+	r := newTestRouter(t, RouterConfig{})
+	server := httptest.NewServer(r.server.Handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("got Content-Type '%v', want 'text/event-stream'", contentType)
+	}
+
+	// The headers are only sent once the request has subscribed
+	r.broadcaster.publish(testMessage(streamRead, "04A1B2C3"))
+	lines := bufio.NewReader(resp.Body)
+	var stage, data string
+	for stage == "" || data == "" {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unable to read the stream: %v", err)
+		}
+		if value, found := strings.CutPrefix(line, "event: "); found {
+			stage = strings.TrimSpace(value)
+		}
+		if value, found := strings.CutPrefix(line, "data: "); found {
+			data = value
+		}
+	}
+	if stage != streamRead {
+		t.Errorf("got event '%v', want '%v'", stage, streamRead)
+	}
+	var result readResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		t.Fatalf("unable to unmarshal '%v': %v", data, err)
+	}
+	if result.UID != "04A1B2C3" || result.ReaderID != "default" {
+		t.Errorf("got %+v, want '04A1B2C3' from 'default'", result)
+	}
+
+	// The client going away unsubscribes it
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.broadcaster.Lock()
+		subscribers := len(r.broadcaster.subscribers)
+		r.broadcaster.Unlock()
+		if subscribers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still %v subscribers after the client went away", subscribers)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}